@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// User is account which owns pastes uploaded with its API tokens
+type User struct {
+	Name string
+	// Created is time in UTC and UnixNano when user registered
+	Created int64
+}
+
+// RegistrationOpen allows anyone to create accounts
+var RegistrationOpen = true
+
+// Errors of accounts
+var (
+	ErrInvalidToken = &StatusError{http.StatusUnauthorized, "401 - Invalid API token"}
+	ErrUserTaken    = &StatusError{http.StatusConflict, "409 - This user name already taken!"}
+)
+
+// NewToken return random API token
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// tokenKey return key of token in "tokens" bucket, tokens are random
+// so they are stored as plain SHA-256 hashes which can be looked up
+func tokenKey(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return h[:]
+}
+
+// CreateUser save new user and return its first API token
+func CreateUser(name string) (string, error) {
+	token, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	user := User{Name: name, Created: time.Now().UTC().UnixNano()}
+	var u bytes.Buffer
+	if err := gob.NewEncoder(&u).Encode(user); err != nil {
+		return "", err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		users := tx.Bucket([]byte("users"))
+		if users.Get([]byte(name)) != nil {
+			return ErrUserTaken
+		}
+		if err := users.Put([]byte(name), u.Bytes()); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("tokens")).Put(tokenKey(token), []byte(name))
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// IssueToken add new API token to user and return it
+func IssueToken(user *User) (string, error) {
+	token, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("tokens")).Put(tokenKey(token), []byte(user.Name))
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RevokeToken remove API token, it can't be used anymore
+func RevokeToken(token string) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("tokens")).Delete(tokenKey(token))
+	})
+}
+
+// UserByToken return owner of API token or nil if token is unknown
+func UserByToken(token string) (user *User, err error) {
+	err = db.View(func(tx *bbolt.Tx) error {
+		name := tx.Bucket([]byte("tokens")).Get(tokenKey(token))
+		if name == nil {
+			return nil
+		}
+		v := tx.Bucket([]byte("users")).Get(name)
+		if v == nil {
+			return nil
+		}
+		user = &User{}
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(user)
+	})
+	return
+}
+
+// bearerToken return token from "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[7:]), true
+}
+
+// Authenticate return user identified by API token from "Authorization:
+// Bearer" header, nil if there is no token and ErrInvalidToken if token
+// is unknown
+func Authenticate(r *http.Request) (*User, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, nil
+	}
+	user, err := UserByToken(token)
+	if err != nil {
+		return nil, err
+	} else if user == nil {
+		return nil, ErrInvalidToken
+	}
+	return user, nil
+}
+
+// requireUser return user identified by API token from request,
+// otherwise it write error and return nil
+func requireUser(w http.ResponseWriter, r *http.Request) *User {
+	user, err := Authenticate(r)
+	if err == nil && user == nil {
+		err = ErrInvalidToken
+	}
+	if err != nil {
+		HTTPStatusError(w, err)
+		return nil
+	}
+	return user
+}
+
+// RegisterUser create account with "name" and respond its API token
+func RegisterUser(w http.ResponseWriter, r *http.Request) {
+	if !RegistrationOpen {
+		HTTPError(w, http.StatusForbidden, "403 - Registration is closed")
+		return
+	}
+	name := r.FormValue("name")
+	if err := ValidateName(name); err != nil {
+		HTTPError(w, http.StatusBadRequest, "400 - "+err.Error())
+		return
+	}
+
+	token, err := CreateUser(name)
+	if err != nil {
+		HTTPStatusError(w, err)
+		return
+	}
+	w.Write([]byte(token))
+}
+
+// CreateToken respond new API token for user of token from request
+func CreateToken(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	token, err := IssueToken(user)
+	if err != nil {
+		HTTPStatusError(w, err)
+		return
+	}
+	w.Write([]byte(token))
+}
+
+// DeleteToken revoke API token from request
+func DeleteToken(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	token, _ := bearerToken(r)
+	if err := RevokeToken(token); err != nil {
+		HTTPStatusError(w, err)
+	}
+}
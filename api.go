@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// ownerIndex return bucket with names of files of owner, it is created
+// if tx is writable
+func ownerIndex(tx *bbolt.Tx, owner string) (*bbolt.Bucket, error) {
+	owners := tx.Bucket([]byte("owners"))
+	if !tx.Writable() {
+		return owners.Bucket([]byte(owner)), nil
+	}
+	return owners.CreateBucketIfNotExists([]byte(owner))
+}
+
+// indexOwned add file to index of its owner files
+func indexOwned(tx *bbolt.Tx, w *WpasteFile) error {
+	if len(w.Owner) == 0 {
+		return nil
+	}
+	index, err := ownerIndex(tx, w.Owner)
+	if err != nil {
+		return err
+	}
+	return index.Put(w.Name, []byte{})
+}
+
+// unindexOwned remove file from index of its owner files
+func unindexOwned(tx *bbolt.Tx, w *WpasteFile) error {
+	if len(w.Owner) == 0 {
+		return nil
+	}
+	if index := tx.Bucket([]byte("owners")).Bucket([]byte(w.Owner)); index != nil {
+		return index.Delete(w.Name)
+	}
+	return nil
+}
+
+// indexAllOwned add all owned files to index, used when index is created
+func indexAllOwned(tx *bbolt.Tx) error {
+	return tx.Bucket([]byte("files")).ForEach(func(k, v []byte) error {
+		f, err := DeserializeWpasteFile(v)
+		if err != nil {
+			return err
+		}
+		return indexOwned(tx, f)
+	})
+}
+
+// MaxListLimit is max number of files in one page of list
+const MaxListLimit = 1000
+
+// PasteInfo is metadata of file sent by API
+type PasteInfo struct {
+	Name      string     `json:"name"`
+	Size      int        `json:"size"`
+	Type      string     `json:"type,omitempty"`
+	Filename  string     `json:"filename,omitempty"`
+	Lang      string     `json:"lang,omitempty"`
+	Files     []string   `json:"files,omitempty"`
+	Created   time.Time  `json:"created"`
+	Edited    *time.Time `json:"edited,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Expired   bool       `json:"expired"`
+	Protected bool       `json:"protected"`
+	Editable  bool       `json:"editable"`
+}
+
+// Info return metadata of file
+func (w *WpasteFile) Info() PasteInfo {
+	info := PasteInfo{
+		Name:      string(w.Name),
+		Size:      len(w.Data),
+		Type:      w.Type,
+		Filename:  w.Filename,
+		Lang:      w.Lang,
+		Created:   time.Unix(0, w.Created).UTC(),
+		Expired:   w.Expired(),
+		Protected: len(w.AccessHash) != 0,
+		Editable:  len(w.EditHash) != 0,
+	}
+	for _, f := range w.Files {
+		info.Size += len(f.Data)
+		info.Files = append(info.Files, f.Filename)
+	}
+	if w.Edited != 0 {
+		edited := time.Unix(0, w.Edited).UTC()
+		info.Edited = &edited
+	}
+	if w.ExpiresAfter != 0 {
+		expires := time.Unix(0, w.ExpiresAfter).UTC()
+		info.Expires = &expires
+	}
+	return info
+}
+
+// parseDate parse RFC 3339 time or date like 2006-01-02
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// ListPastes respond JSON with files of user ordered by name, page
+// starts after "cursor" and has up to "limit" files, files can be
+// filtered by "status" (active or expired), name "prefix" and creation
+// time with "since" and "until"
+func ListPastes(w http.ResponseWriter, r *http.Request) {
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	limit := 50
+	if l := r.FormValue("limit"); len(l) != 0 {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > MaxListLimit {
+			HTTPError(w, http.StatusBadRequest, "400 - Limit should be from 1 to 1000")
+			return
+		}
+	}
+	status := r.FormValue("status")
+	if status != "" && status != "active" && status != "expired" {
+		HTTPError(w, http.StatusBadRequest, "400 - Status should be active or expired")
+		return
+	}
+	var since, until time.Time
+	for _, p := range []struct {
+		param string
+		t     *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		if v := r.FormValue(p.param); len(v) != 0 {
+			t, err := parseDate(v)
+			if err != nil {
+				HTTPError(w, http.StatusBadRequest, "400 - Invalid "+p.param+" date")
+				return
+			}
+			*p.t = t
+		}
+	}
+	prefix := []byte(r.FormValue("prefix"))
+	cursor := []byte(r.FormValue("cursor"))
+
+	result := struct {
+		Pastes []PasteInfo `json:"pastes"`
+		Next   string      `json:"next,omitempty"`
+	}{Pastes: []PasteInfo{}}
+	err := db.View(func(tx *bbolt.Tx) error {
+		index, err := ownerIndex(tx, user.Name)
+		if err != nil || index == nil {
+			return err
+		}
+		files := tx.Bucket([]byte("files"))
+
+		start := prefix
+		if bytes.Compare(cursor, start) > 0 {
+			start = cursor
+		}
+		c := index.Cursor()
+		for k, _ := c.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if bytes.Equal(k, cursor) {
+				continue
+			}
+			v := files.Get(k)
+			if v == nil {
+				continue
+			}
+			file, err := DeserializeWpasteFile(v)
+			if err != nil {
+				return err
+			}
+			created := time.Unix(0, file.Created)
+			switch {
+			case status == "active" && file.Expired(), status == "expired" && !file.Expired():
+				continue
+			case !since.IsZero() && created.Before(since), !until.IsZero() && !created.Before(until):
+				continue
+			}
+			if len(result.Pastes) == limit {
+				result.Next = result.Pastes[limit-1].Name
+				break
+			}
+			result.Pastes = append(result.Pastes, file.Info())
+		}
+		return nil
+	})
+	if err != nil {
+		HTTPStatusError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
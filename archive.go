@@ -0,0 +1,54 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"time"
+)
+
+// WriteTarGz write gzipped tar archive with files to w
+func WriteTarGz(w io.Writer, files []BundleFile, modTime time.Time) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, f := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.Filename,
+			Mode:     0644,
+			Size:     int64(len(f.Data)),
+			ModTime:  modTime,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// WriteZip write zip archive with files to w
+func WriteZip(w io.Writer, files []BundleFile, modTime time.Time) error {
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		header := &zip.FileHeader{
+			Name:   f.Filename,
+			Method: zip.Deflate,
+		}
+		header.Modified = modTime
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(f.Data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
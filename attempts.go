@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// TrustProxy is true if server runs behind proxy like nginx which sets
+// X-Real-IP header, otherwise header is ignored as any client can send it
+var TrustProxy bool
+
+// proxyWarning is logged once when X-Real-IP is ignored
+var proxyWarning sync.Once
+
+// ClientIP return address of client, X-Real-IP header set by trusted
+// proxy is preferred over address of connection
+func ClientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Real-IP"); len(ip) != 0 {
+		if TrustProxy {
+			return ip
+		}
+		proxyWarning.Do(func() {
+			log.Println("WARNING: X-Real-IP header is ignored, run server with -trust-proxy flag " +
+				"if it is behind proxy, otherwise all clients share rate limits, lockouts and quotas")
+		})
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// AttemptPolicy is how many failed password attempts are allowed before
+// lockout, lockout doubles after each next failure
+type AttemptPolicy struct {
+	// Free is number of failures without lockout
+	Free int
+	// Lockout is duration of the first lockout
+	Lockout    time.Duration
+	MaxLockout time.Duration
+	// Window is how long failures are remembered after the last one
+	Window time.Duration
+}
+
+// FileAttempts and ClientAttempts limit failed password attempts for
+// each file and each client, file limit is higher so one client can't
+// easily lock file for everybody
+var (
+	FileAttempts   = AttemptPolicy{Free: 20, Lockout: time.Second, MaxLockout: time.Hour, Window: 24 * time.Hour}
+	ClientAttempts = AttemptPolicy{Free: 5, Lockout: time.Second, MaxLockout: time.Hour, Window: 24 * time.Hour}
+)
+
+// attempts is failed attempts stored in "attempts" bucket by "f/" + file
+// name and "c/" + client IP keys
+type attempts struct {
+	Failures int
+	// Last is time in UTC and UnixNano of the last failure
+	Last int64
+	// LockedUntil is time in UTC and UnixNano when lockout ends
+	LockedUntil int64
+}
+
+func attemptKeys(r *http.Request, name []byte) [][]byte {
+	return [][]byte{append([]byte("f/"), name...), []byte("c/" + ClientIP(r))}
+}
+
+func decodeAttempts(v []byte) (*attempts, error) {
+	var a attempts
+	err := gob.NewDecoder(bytes.NewReader(v)).Decode(&a)
+	return &a, err
+}
+
+// CheckAttempts return time left until lockout of file or client ends,
+// it is 0 if password can be checked
+func CheckAttempts(r *http.Request, name []byte) (wait time.Duration) {
+	now := time.Now().UTC().UnixNano()
+	db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("attempts"))
+		for _, key := range attemptKeys(r, name) {
+			v := bucket.Get(key)
+			if v == nil {
+				continue
+			}
+			a, err := decodeAttempts(v)
+			if err != nil {
+				return err
+			}
+			if left := time.Duration(a.LockedUntil - now); left > wait {
+				wait = left
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// FailedAttempt count failed password attempt for file and client
+// and lock them out if they have too many failures
+func FailedAttempt(r *http.Request, name []byte) error {
+	now := time.Now().UTC().UnixNano()
+	return db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("attempts"))
+		for i, key := range attemptKeys(r, name) {
+			policy := FileAttempts
+			if i == 1 {
+				policy = ClientAttempts
+			}
+
+			a := &attempts{}
+			if v := bucket.Get(key); v != nil {
+				var err error
+				if a, err = decodeAttempts(v); err != nil {
+					return err
+				}
+			}
+			if now-a.Last > int64(policy.Window) {
+				a.Failures = 0
+			}
+			a.Failures++
+			a.Last = now
+			if over := a.Failures - policy.Free; over > 0 {
+				lockout := policy.MaxLockout
+				if over < 32 && policy.Lockout<<(over-1) < lockout {
+					lockout = policy.Lockout << (over - 1)
+				}
+				a.LockedUntil = now + int64(lockout)
+			}
+
+			var v bytes.Buffer
+			if err := gob.NewEncoder(&v).Encode(a); err != nil {
+				return err
+			}
+			if err := bucket.Put(key, v.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteOldAttempts remove failures which are not remembered anymore
+func DeleteOldAttempts() error {
+	now := time.Now().UTC().UnixNano()
+	return db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("attempts"))
+		var old [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			a, err := decodeAttempts(v)
+			if err != nil {
+				return err
+			}
+			window := FileAttempts.Window
+			if k[0] == 'c' {
+				window = ClientAttempts.Window
+			}
+			if now > a.LockedUntil && now-a.Last > int64(window) {
+				old = append(old, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range old {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// failedPassword count failed attempt if client sent password, requests
+// without password are not guesses
+func failedPassword(r *http.Request, name, password []byte) {
+	if len(password) == 0 {
+		return
+	}
+	if err := FailedAttempt(r, name); err != nil {
+		log.Println(err)
+	}
+}
+
+// passwordLocked write 429 and return true if client sent password while
+// it or file is locked out
+func passwordLocked(w http.ResponseWriter, r *http.Request, name, password []byte) bool {
+	if len(password) == 0 {
+		return false
+	}
+	if wait := CheckAttempts(r, name); wait > 0 {
+		tooManyAttempts(w, wait)
+		return true
+	}
+	return false
+}
+
+// tooManyAttempts write 429 with Retry-After header
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+	HTTPError(w, http.StatusTooManyRequests, "429 - Too many wrong passwords, try again later")
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// CollabSaveInterval is how often changes made in collaborative
+// session are saved to database
+var CollabSaveInterval = 5 * time.Second
+
+// collabMessage is message of collaborative editing protocol
+type collabMessage struct {
+	// Type is "init", "op", "ack" or "error"
+	Type string `json:"type"`
+	// Rev is revision of document operation was made on for client
+	// messages and revision after operation for server messages
+	Rev   int       `json:"rev"`
+	Doc   *string   `json:"doc,omitempty"`
+	Op    Operation `json:"op,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+// collabClient is editor connected to session
+type collabClient struct {
+	send chan collabMessage
+}
+
+// collabSession is document which is edited by several clients, client
+// operations are transformed against operations made since their revision,
+// applied and sent to other clients
+type collabSession struct {
+	mu      sync.Mutex
+	name    string
+	doc     []rune
+	maxSize int64
+	history []Operation
+	clients map[*collabClient]bool
+	dirty   bool
+	saved   []byte
+	closed  bool
+	done    chan struct{}
+}
+
+var (
+	collabMu       sync.Mutex
+	collabSessions = map[string]*collabSession{}
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// joinCollab add client to session of file, session is started if
+// nobody edits file yet
+func joinCollab(file *WpasteFile) (*collabSession, *collabClient) {
+	collabMu.Lock()
+	defer collabMu.Unlock()
+
+	name := string(file.Name)
+	s := collabSessions[name]
+	if s == nil {
+		maxSize := file.MaxSize
+		if maxSize == 0 {
+			maxSize = MaxAppendedSize
+		}
+		s = &collabSession{
+			name:    name,
+			doc:     []rune(string(file.Data)),
+			maxSize: maxSize,
+			clients: map[*collabClient]bool{},
+			saved:   file.Data,
+			done:    make(chan struct{}),
+		}
+		collabSessions[name] = s
+		go s.run()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &collabClient{send: make(chan collabMessage, 256)}
+	s.clients[c] = true
+	doc := string(s.doc)
+	c.send <- collabMessage{Type: "init", Rev: len(s.history), Doc: &doc}
+	return s, c
+}
+
+// leave remove client from session, session is saved and stopped
+// when the last client leaves
+func (s *collabSession) leave(c *collabClient) {
+	collabMu.Lock()
+	defer collabMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.clients[c] {
+		return
+	}
+	s.drop(c)
+	if len(s.clients) == 0 && !s.closed {
+		s.closed = true
+		delete(collabSessions, s.name)
+		close(s.done)
+	}
+}
+
+// drop disconnect client, s.mu should be locked
+func (s *collabSession) drop(c *collabClient) {
+	delete(s.clients, c)
+	close(c.send)
+}
+
+// reply send message to client, client is dropped if it doesn't read
+// messages fast enough, s.mu should be locked
+func (s *collabSession) reply(c *collabClient, msg collabMessage) {
+	if !s.clients[c] {
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+		s.drop(c)
+	}
+}
+
+// fail send error message to client
+func (s *collabSession) fail(c *collabClient, description string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reply(c, collabMessage{Type: "error", Rev: len(s.history), Error: description})
+}
+
+// receive apply operation made by client on revision rev, sender gets
+// "ack" and other clients get transformed operation
+func (s *collabSession) receive(c *collabClient, rev int, op Operation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rev < 0 || rev > len(s.history) {
+		s.reply(c, collabMessage{Type: "error", Rev: len(s.history), Error: "Invalid revision"})
+		return
+	}
+	var err error
+	for _, concurrent := range s.history[rev:] {
+		if op, _, err = Transform(op, concurrent); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = s.apply(c, op)
+	}
+	if err != nil {
+		s.reply(c, collabMessage{Type: "error", Rev: len(s.history), Error: err.Error()})
+		return
+	}
+	s.reply(c, collabMessage{Type: "ack", Rev: len(s.history)})
+}
+
+// apply operation to document and send it to all clients except
+// sender, s.mu should be locked
+func (s *collabSession) apply(sender *collabClient, op Operation) error {
+	doc, err := op.Apply(s.doc)
+	if err != nil {
+		return err
+	} else if int64(len(string(doc))) > s.maxSize {
+		return fmt.Errorf("Max file size is %d bytes", s.maxSize)
+	}
+	s.doc = doc
+	s.history = append(s.history, op)
+	s.dirty = true
+	for c := range s.clients {
+		if c != sender {
+			s.reply(c, collabMessage{Type: "op", Rev: len(s.history), Op: op})
+		}
+	}
+	return nil
+}
+
+// run save session periodically and turn changes made outside of it
+// into operations until session is stopped
+func (s *collabSession) run() {
+	events := Events.Subscribe(s.name)
+	defer func() { Events.Unsubscribe(s.name, events) }()
+	ticker := time.NewTicker(CollabSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			s.save()
+			return
+		case <-ticker.C:
+			s.save()
+		case e, ok := <-events:
+			if !ok {
+				events = Events.Subscribe(s.name)
+			} else if e.Type == "delete" {
+				s.close("File was deleted")
+				return
+			} else {
+				s.external(e)
+			}
+		}
+	}
+}
+
+// external apply edit or append made outside of session
+func (s *collabSession) external(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var op Operation
+	if e.Type == "append" {
+		op = op.Retain(len(s.doc)).Insert(string(e.Data))
+	} else if !bytes.Equal(e.Data, s.saved) {
+		op = op.Delete(len(s.doc)).Insert(string(e.Data))
+	}
+	if len(op) == 0 {
+		return
+	}
+	s.doc, _ = op.Apply(s.doc)
+	s.history = append(s.history, op)
+	for c := range s.clients {
+		s.reply(c, collabMessage{Type: "op", Rev: len(s.history), Op: op})
+	}
+	// saved content may be older than external change, so the next save
+	// writes document even if it is the same
+	s.dirty = true
+	s.saved = nil
+}
+
+// save write document to database if it was changed since last save
+func (s *collabSession) save() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty {
+		return
+	}
+	data := []byte(string(s.doc))
+	err := Events.Update(s.name, func() (Event, error) {
+		err := UpdateWpaste([]byte(s.name), func(file *WpasteFile) error {
+			if file.Expired() {
+				return ErrGone
+			}
+			file.Data = data
+			file.Edited = time.Now().UTC().UnixNano()
+			return nil
+		})
+		return Event{Type: "edit", Data: data}, err
+	})
+	if err == ErrNotFound || err == ErrGone {
+		s.dirty = false
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+	s.dirty = false
+	s.saved = data
+}
+
+// close disconnect all clients with error message and stop session
+func (s *collabSession) close(description string) {
+	collabMu.Lock()
+	defer collabMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.clients {
+		s.reply(c, collabMessage{Type: "error", Rev: len(s.history), Error: description})
+		if s.clients[c] {
+			s.drop(c)
+		}
+	}
+	if !s.closed {
+		s.closed = true
+		delete(collabSessions, s.name)
+	}
+}
+
+// CollabFile upgrade connection to WebSocket for collaborative editing
+// of text file, clients send operations made on revision they know and
+// server merges them with operational transformation
+func CollabFile(w http.ResponseWriter, r *http.Request) {
+	ID := mux.Vars(r)["id"]
+	user, err := Authenticate(r)
+	if err != nil {
+		HTTPStatusError(w, err)
+		return
+	}
+	file, err := OpenWpasteByName([]byte(ID))
+	if err != nil {
+		HTTPServerError(w)
+		return
+	}
+
+	r.ParseForm()
+	if !file.Exist() {
+		HTTPError(w, http.StatusNotFound, "404 - File not found")
+		return
+	} else if file.Expired() {
+		HTTPError(w, http.StatusGone, "410 - File is no longer available")
+		return
+	} else if passwordLocked(w, r, file.Name, EditPassword(r)) {
+		return
+	} else if !file.AllowEditBy(user, EditPassword(r)) && !allowShare(r, file.Name, ScopeEdit) {
+		failedPassword(r, file.Name, EditPassword(r))
+		HTTPError(w, http.StatusUnauthorized, "401 - Invalid password")
+		return
+	} else if file.Bundle() || !file.Text() {
+		HTTPError(w, http.StatusNotAcceptable, "406 - Only text files can be edited together")
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn.SetReadLimit(MaxFileSize)
+
+	session, client := joinCollab(file)
+	defer session.leave(client)
+	go func() {
+		for msg := range client.send {
+			if conn.WriteJSON(msg) != nil {
+				break
+			}
+		}
+		conn.Close()
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		var msg collabMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			session.fail(client, "Invalid message")
+			continue
+		} else if msg.Type != "op" {
+			session.fail(client, "Unknown message type")
+			continue
+		}
+		session.receive(client, msg.Rev, msg.Op)
+	}
+}
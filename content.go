@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// activeTypes is media types which browser may execute, such files
+// are always sent as attachments
+var activeTypes = map[string]bool{
+	"text/html":             true,
+	"text/xml":              true,
+	"application/xml":       true,
+	"application/xhtml+xml": true,
+	"image/svg+xml":         true,
+}
+
+// textTypes is media types out of text/* which can be highlighted
+var textTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/x-sh":       true,
+	"application/xml":        true,
+	"application/yaml":       true,
+}
+
+// mediaType return media type without params or empty string if
+// content type is invalid
+func mediaType(contentType string) string {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediatype
+}
+
+// ActiveType return true if content type may be executed by browser
+func ActiveType(contentType string) bool {
+	mediatype := mediaType(contentType)
+	return activeTypes[mediatype] || strings.HasSuffix(mediatype, "+xml")
+}
+
+// TextType return true if content type is text and can be highlighted
+func TextType(contentType string) bool {
+	mediatype := mediaType(contentType)
+	return strings.HasPrefix(mediatype, "text/") || textTypes[mediatype] ||
+		strings.HasSuffix(mediatype, "+json") || strings.HasSuffix(mediatype, "+xml")
+}
+
+// ContentType return content type declared by client or detected by data
+// if it is not declared
+func ContentType(declared string, data []byte) (string, error) {
+	if len(declared) == 0 || declared == "application/octet-stream" {
+		return http.DetectContentType(data), nil
+	}
+	mediatype, params, err := mime.ParseMediaType(declared)
+	if err != nil {
+		return "", errors.New("Invalid content type")
+	}
+	return mime.FormatMediaType(mediatype, params), nil
+}
+
+// ValidateFilename return error which describes why filename can't be
+// used as original file name or nil if it can
+func ValidateFilename(filename string) error {
+	if len(strings.TrimSpace(filename)) == 0 || len(filename) > 255 {
+		return errors.New("Filename length should be from 1 to 255 characters")
+	} else if filename == "." || filename == ".." {
+		return errors.New("Invalid filename")
+	}
+	for _, c := range filename {
+		if c < ' ' || c == 0x7f || c == '/' || c == '\\' {
+			return errors.New("Filename can't contain slashes and control characters")
+		}
+	}
+	return nil
+}
+
+// MaxFileSize is max size of uploaded content
+const MaxFileSize = 2 << 20
+
+// ReadFile return content of "f" field, if it is a file part of
+// multipart form it also return filename and content type sent by client,
+// "filename" and "type" fields override them
+func ReadFile(r *http.Request) (data []byte, filename, contentType string, err error) {
+	err = r.ParseMultipartForm(MaxFileSize)
+	if err != nil && err != http.ErrNotMultipart {
+		return
+	}
+	if r.MultipartForm != nil && len(r.MultipartForm.File["f"]) != 0 {
+		header := r.MultipartForm.File["f"][0]
+		f, err := header.Open()
+		if err != nil {
+			return nil, "", "", err
+		}
+		defer f.Close()
+		if data, err = ioutil.ReadAll(f); err != nil {
+			return nil, "", "", err
+		}
+		filename = path.Base(strings.ReplaceAll(header.Filename, "\\", "/"))
+		contentType = header.Header.Get("Content-Type")
+	} else {
+		data = []byte(r.FormValue("f"))
+	}
+	if len(r.FormValue("filename")) != 0 {
+		filename = r.FormValue("filename")
+	}
+	if len(r.FormValue("type")) != 0 {
+		contentType = r.FormValue("type")
+	}
+	return data, filename, contentType, nil
+}
+
+// ReservedFilenames can't be used in multi-file paste because routes
+// of paste like /<name>/events take these paths
+var ReservedFilenames = map[string]bool{"events": true, "collab": true, "shares": true}
+
+// ReadBundle return files of multi-file paste if there are several file
+// parts in "f" field, otherwise it return nil
+func ReadBundle(r *http.Request) ([]BundleFile, error) {
+	if r.MultipartForm == nil || len(r.MultipartForm.File["f"]) < 2 {
+		return nil, nil
+	}
+
+	var files []BundleFile
+	seen := map[string]bool{}
+	for _, header := range r.MultipartForm.File["f"] {
+		filename := path.Base(strings.ReplaceAll(header.Filename, "\\", "/"))
+		if err := ValidateFilename(filename); err != nil {
+			return nil, err
+		} else if ReservedFilenames[filename] {
+			return nil, errors.New("Filename " + filename + " is reserved")
+		} else if seen[filename] {
+			return nil, errors.New("Filenames should be unique")
+		}
+		seen[filename] = true
+
+		f, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		contentType, err := ContentType(header.Header.Get("Content-Type"), data)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, BundleFile{Filename: filename, Type: contentType, Data: data})
+	}
+	return files, nil
+}
+
+// CountLines return number of lines in data, trailing newline
+// doesn't start a new line
+func CountLines(data []byte) int {
+	n := bytes.Count(data, []byte("\n"))
+	if len(data) != 0 && data[len(data)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// LineRange return lines from "from" to "to" of data, lines are numbered
+// from 1 and range includes both ends
+func LineRange(data []byte, from, to int) []byte {
+	if from < 1 {
+		from = 1
+	}
+	start, line := 0, 1
+	for ; line < from && start < len(data); line++ {
+		i := bytes.IndexByte(data[start:], '\n')
+		if i == -1 {
+			return nil
+		}
+		start += i + 1
+	}
+	end := start
+	for ; line <= to && end < len(data); line++ {
+		i := bytes.IndexByte(data[end:], '\n')
+		if i == -1 {
+			return data[start:]
+		}
+		end += i + 1
+	}
+	return data[start:end]
+}
+
+// ParseLineRange parse range of lines like "5", "5-10" or "L5-L10"
+func ParseLineRange(s string) (from, to int, err error) {
+	bounds := strings.SplitN(s, "-", 2)
+	from, err = strconv.Atoi(strings.TrimPrefix(bounds[0], "L"))
+	if err != nil {
+		return 0, 0, errors.New("Invalid lines range")
+	}
+	to = from
+	if len(bounds) == 2 {
+		to, err = strconv.Atoi(strings.TrimPrefix(bounds[1], "L"))
+		if err != nil {
+			return 0, 0, errors.New("Invalid lines range")
+		}
+	}
+	if from < 1 || to < from {
+		return 0, 0, errors.New("Lines range should be like 5-10 and start from 1")
+	}
+	return from, to, nil
+}
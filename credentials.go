@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Headers with credentials, they are preferred over params because
+// URLs end up in logs of proxies and browsers history
+const (
+	AccessPasswordHeader = "X-Wpaste-Access-Password"
+	EditPasswordHeader   = "X-Wpaste-Edit-Password"
+	ShareTokenHeader     = "X-Wpaste-Share"
+)
+
+// credentialParams is params of request which contain credentials
+var credentialParams = []string{"ap", "ep", "share"}
+
+// StrictCredentials rejects requests with credentials in URL
+var StrictCredentials = false
+
+// credential return value of header or param if header is not set
+func credential(r *http.Request, header, param string) string {
+	if v := r.Header.Get(header); len(v) != 0 {
+		return v
+	}
+	return r.FormValue(param)
+}
+
+// basicPassword return password from "Authorization: Basic" header,
+// user name is ignored
+func basicPassword(r *http.Request) (string, bool) {
+	_, password, ok := r.BasicAuth()
+	return password, ok && len(password) != 0
+}
+
+// AccessPassword return access password from X-Wpaste-Access-Password
+// header, password of Basic authorization or "ap" param
+func AccessPassword(r *http.Request) []byte {
+	if v := r.Header.Get(AccessPasswordHeader); len(v) != 0 {
+		return []byte(v)
+	} else if password, ok := basicPassword(r); ok {
+		return []byte(password)
+	}
+	return []byte(r.FormValue("ap"))
+}
+
+// EditPassword return edit password from X-Wpaste-Edit-Password
+// header, password of Basic authorization or "ep" param
+func EditPassword(r *http.Request) []byte {
+	if v := r.Header.Get(EditPasswordHeader); len(v) != 0 {
+		return []byte(v)
+	} else if password, ok := basicPassword(r); ok {
+		return []byte(password)
+	}
+	return []byte(r.FormValue("ep"))
+}
+
+// ShareToken return share token from X-Wpaste-Share header or "share" param
+func ShareToken(r *http.Request) string {
+	return credential(r, ShareTokenHeader, "share")
+}
+
+// rejectURLCredentials responds 400 to requests with credentials in URL
+// if StrictCredentials is set
+func rejectURLCredentials(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if StrictCredentials {
+			query := r.URL.Query()
+			for _, param := range credentialParams {
+				if _, ok := query[param]; ok {
+					HTTPError(w, http.StatusBadRequest, "400 - Passwords should be sent in headers or form body, not in URL")
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Event is change of file which is sent to its followers
+type Event struct {
+	// Type is "edit", "append" or "delete"
+	Type string
+	// Offset is position in file where Data starts
+	Offset int
+	// Data is new content for "edit" and added data for "append"
+	Data []byte
+}
+
+// Broker delivers events about files changes to subscribers
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan Event]bool
+	// updating is locked while change is saved and published
+	updating sync.Mutex
+}
+
+// NewBroker creates Broker and return it
+func NewBroker() *Broker {
+	return &Broker{subscribers: map[string]map[chan Event]bool{}}
+}
+
+// Events is broker for changes of all files
+var Events = NewBroker()
+
+// Subscribe return channel which receives events of file with name,
+// channel is closed if subscriber doesn't read it fast enough
+func (b *Broker) Subscribe(name string) chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, 64)
+	if b.subscribers[name] == nil {
+		b.subscribers[name] = map[chan Event]bool{}
+	}
+	b.subscribers[name][ch] = true
+	return ch
+}
+
+// Unsubscribe stops sending events to channel
+func (b *Broker) Unsubscribe(name string, ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subscribers[name][ch] {
+		b.remove(name, ch)
+	}
+}
+
+func (b *Broker) remove(name string, ch chan Event) {
+	delete(b.subscribers[name], ch)
+	if len(b.subscribers[name]) == 0 {
+		delete(b.subscribers, name)
+	}
+	close(ch)
+}
+
+// Publish send event to all subscribers of file without blocking
+func (b *Broker) Publish(name string, e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers[name] {
+		select {
+		case ch <- e:
+		default:
+			b.remove(name, ch)
+		}
+	}
+}
+
+// Update call fn which saves change of file and publish event returned
+// by it if there is no error, changes are saved one by one so events are
+// published in the same order
+func (b *Broker) Update(name string, fn func() (Event, error)) error {
+	b.updating.Lock()
+	defer b.updating.Unlock()
+
+	e, err := fn()
+	if err == nil {
+		b.Publish(name, e)
+	}
+	return err
+}
+
+// Subscribers return number of subscribers of file
+func (b *Broker) Subscribers(name string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subscribers[name])
+}
+
+// WriteSSE write event in Server-Sent Events format, every line of data
+// is sent as separate "data" field
+func WriteSSE(w io.Writer, event string, data []byte) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "event: %s\n", event)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -3,11 +3,13 @@ module github.com/waika28/wpaste.cyou
 go 1.15
 
 require (
+	github.com/alecthomas/chroma v0.10.0
 	github.com/appleboy/gofight v2.0.0+incompatible
 	github.com/buger/jsonparser v1.1.1 // indirect
 	github.com/gin-gonic/gin v1.6.3 // indirect
 	github.com/gomarkdown/markdown v0.0.0-20201113031856-722100d81a8e
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/labstack/echo v3.3.10+incompatible // indirect
 	github.com/labstack/gommon v0.3.0 // indirect
 	github.com/stretchr/testify v1.7.0
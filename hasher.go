@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher makes hashes of passwords
+type PasswordHasher interface {
+	// Hash return hash of password which can be checked with VerifyPassword
+	Hash(password []byte) ([]byte, error)
+	// NeedsRehash return true if hash was made by other algorithm or
+	// with other params than hasher uses
+	NeedsRehash(hash []byte) bool
+}
+
+// Argon2idHasher hashes passwords with argon2id, hashes are encoded
+// like $argon2id$v=19$m=65536,t=1,p=4$salt$key
+type Argon2idHasher struct {
+	// Time is number of passes over memory
+	Time uint32
+	// Memory is size of memory in KiB
+	Memory  uint32
+	Threads uint8
+}
+
+// argon2Salt and argon2KeyLen are lengths of salt and key in bytes
+const (
+	argon2Salt   = 16
+	argon2KeyLen = 32
+)
+
+// DefaultHasher is hasher recommended by argon2 package
+var DefaultHasher = &Argon2idHasher{Time: 1, Memory: 64 * 1024, Threads: 4}
+
+// Hasher is used for new passwords and old hashes are upgraded to it
+var Hasher PasswordHasher = DefaultHasher
+
+// argon2Slots limits number of argon2id keys computed at once as each
+// of them takes Memory KiB, other requests wait for free slot
+var argon2Slots = make(chan struct{}, 4)
+
+// SetArgon2Parallel set how many argon2id keys can be computed at once
+func SetArgon2Parallel(n int) {
+	argon2Slots = make(chan struct{}, n)
+}
+
+// argon2Key return argon2id key when there is free slot
+func argon2Key(password, salt []byte, params *Argon2idHasher, keyLen uint32) []byte {
+	slots := argon2Slots
+	slots <- struct{}{}
+	defer func() { <-slots }()
+	return argon2.IDKey(password, salt, params.Time, params.Memory, params.Threads, keyLen)
+}
+
+// Hash implements PasswordHasher
+func (h *Argon2idHasher) Hash(password []byte) ([]byte, error) {
+	salt := make([]byte, argon2Salt)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := argon2Key(password, salt, h, argon2KeyLen)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// NeedsRehash implements PasswordHasher
+func (h *Argon2idHasher) NeedsRehash(hash []byte) bool {
+	params, _, _, err := decodeArgon2id(hash)
+	return err != nil || *params != *h
+}
+
+// decodeArgon2id return params, salt and key of argon2id hash
+func decodeArgon2id(hash []byte) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, errors.New("not argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, errors.New("unsupported argon2 version")
+	}
+	params := &Argon2idHasher{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return params, salt, key, nil
+}
+
+// BcryptHasher hashes passwords with bcrypt, it was used before argon2id
+// and is kept for setups which need it, bcrypt uses only first 72 bytes
+// of password
+type BcryptHasher struct {
+	Cost int
+}
+
+// Hash implements PasswordHasher
+func (h *BcryptHasher) Hash(password []byte) ([]byte, error) {
+	return bcrypt.GenerateFromPassword(password, h.Cost)
+}
+
+// NeedsRehash implements PasswordHasher
+func (h *BcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.Cost
+}
+
+// VerifyPassword return true if password matches hash made by any of
+// supported hashers
+func VerifyPassword(hash, password []byte) bool {
+	if bytes.HasPrefix(hash, []byte("$argon2id$")) {
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false
+		}
+		if params.Time == 0 || params.Threads == 0 {
+			return false
+		}
+		other := argon2Key(password, salt, params, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1
+	}
+	return bcrypt.CompareHashAndPassword(hash, password) == nil
+}
+
+// errHashChanged is returned by rehash when password was changed meanwhile
+var errHashChanged = errors.New("hash changed")
+
+// rehash replace hash of file password made by other hasher with hash
+// made by Hasher, it is done in background because password may be
+// checked inside transaction
+func rehash(name, old, password []byte, edit bool) {
+	go func() {
+		hash, err := Hasher.Hash(password)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		err = UpdateWpaste(name, func(file *WpasteFile) error {
+			field := &file.AccessHash
+			if edit {
+				field = &file.EditHash
+			}
+			if !bytes.Equal(*field, old) {
+				return errHashChanged
+			}
+			*field = hash
+			return nil
+		})
+		if err != nil && err != errHashChanged && err != ErrNotFound {
+			log.Println(err)
+		}
+	}()
+}
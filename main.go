@@ -2,18 +2,27 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
+	"mime"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/alecthomas/chroma/lexers"
 	"github.com/gomarkdown/markdown"
 	"github.com/gorilla/mux"
 	"go.etcd.io/bbolt"
@@ -44,6 +53,33 @@ type WpasteFile struct {
 	ExpiresAfter int64
 	// Edited is time in UTC and UnixNano when file edited
 	Edited int64
+	// Lang is language hint for highlighting
+	Lang string
+	// Type is MIME type of Data, empty for files uploaded before it was
+	// stored, such files are plain text
+	Type string
+	// Filename is original name of file
+	Filename string
+	// Files is files of multi-file paste, Data is empty for such pastes
+	Files []BundleFile
+	// MaxSize is max size of Data which can be reached by appending,
+	// MaxAppendedSize is used if it is 0
+	MaxSize int64
+	// Owner is name of user who uploaded file with API token
+	Owner string
+	// Uploader is address of client who uploaded file without API token,
+	// it is used to count usage of storage
+	Uploader string
+}
+
+// MaxAppendedSize is max size of file which can be reached by appending
+const MaxAppendedSize = 16 << 20
+
+// BundleFile is one of files of multi-file paste
+type BundleFile struct {
+	Filename string
+	Type     string
+	Data     []byte
 }
 
 // NewWpasteFile creates Wpastefile and return it
@@ -65,7 +101,7 @@ func NewWpasteFile(name, data []byte, expires int64) *WpasteFile {
 
 // SetAccessHash calculates and set access password hash
 func (w *WpasteFile) SetAccessHash(password []byte) error {
-	accessHash, err := bcrypt.GenerateFromPassword(password, bcrypt.MinCost)
+	accessHash, err := Hasher.Hash(password)
 	if err != nil {
 		return err
 	}
@@ -75,7 +111,7 @@ func (w *WpasteFile) SetAccessHash(password []byte) error {
 
 // SetEditHash calculates and set edit password hash
 func (w *WpasteFile) SetEditHash(password []byte) error {
-	accessEdit, err := bcrypt.GenerateFromPassword(password, bcrypt.MinCost)
+	accessEdit, err := Hasher.Hash(password)
 	if err != nil {
 		return err
 	}
@@ -107,29 +143,171 @@ func (w *WpasteFile) Expired() bool {
 	return false
 }
 
+// Bundle return true if it is multi-file paste
+func (w *WpasteFile) Bundle() bool {
+	return len(w.Files) != 0
+}
+
+// Entry return file of multi-file paste by filename as WpasteFile which
+// shares name, dates and passwords with paste or nil if there is no such file
+func (w *WpasteFile) Entry(filename string) *WpasteFile {
+	for _, f := range w.Files {
+		if f.Filename == filename {
+			entry := *w
+			entry.Files = nil
+			entry.Data, entry.Type, entry.Filename = f.Data, f.Type, f.Filename
+			return &entry
+		}
+	}
+	return nil
+}
+
+// Entries return files of multi-file paste or paste itself as the only file
+func (w *WpasteFile) Entries() []BundleFile {
+	if w.Bundle() {
+		return w.Files
+	}
+	filename := w.Filename
+	if len(filename) == 0 {
+		filename = string(w.Name)
+	}
+	return []BundleFile{{Filename: filename, Type: w.Type, Data: w.Data}}
+}
+
+// Modified return time of last edit or creation time if file wasn't edited
+func (w *WpasteFile) Modified() time.Time {
+	if w.Edited != 0 {
+		return time.Unix(0, w.Edited).UTC()
+	}
+	return time.Unix(0, w.Created).UTC()
+}
+
+// ETag return strong entity tag which is hash of file content
+func (w *WpasteFile) ETag() string {
+	h := sha256.New()
+	if w.Bundle() {
+		for _, f := range w.Files {
+			fmt.Fprintf(h, "%d:%s%d:", len(f.Filename), f.Filename, len(f.Data))
+			h.Write(f.Data)
+		}
+	} else {
+		h.Write(w.Data)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// CacheControl return Cache-Control header for file, protected and
+// editable files should be revalidated on each request
+func (w *WpasteFile) CacheControl() string {
+	if len(w.AccessHash) != 0 {
+		return "private, no-cache"
+	} else if len(w.EditHash) != 0 || len(w.Owner) != 0 {
+		return "public, no-cache"
+	} else if w.ExpiresAfter != 0 {
+		left := (w.ExpiresAfter - time.Now().UTC().UnixNano()) / int64(time.Second)
+		if left < 0 {
+			left = 0
+		}
+		return fmt.Sprintf("public, max-age=%d", left)
+	}
+	return "public, max-age=31536000, immutable"
+}
+
+// Text return true if file can be shown as text
+func (w *WpasteFile) Text() bool {
+	return len(w.Type) == 0 || TextType(w.Type)
+}
+
+// Language return language hint or filename to pick highlighting by it
+func (w *WpasteFile) Language() string {
+	if len(w.Lang) != 0 {
+		return w.Lang
+	}
+	return w.Filename
+}
+
+// ContentDisposition return Content-Disposition header for file,
+// active content is always sent as attachment
+func (w *WpasteFile) ContentDisposition() string {
+	filename := w.Filename
+	if ActiveType(w.Type) {
+		if len(filename) == 0 {
+			filename = string(w.Name)
+		}
+		return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+	} else if len(filename) != 0 {
+		return mime.FormatMediaType("inline", map[string]string{"filename": filename})
+	}
+	return ""
+}
+
 // Exist return true if file found and exist
 func (w *WpasteFile) Exist() bool {
 	return w != nil
 }
 
 // AllowAccess return true if access password is empty or
-// entered password matches access password
+// entered password matches access password, hash made by other
+// hasher is upgraded
 func (w *WpasteFile) AllowAccess(password []byte) bool {
-	if len(w.AccessHash) == 0 || bcrypt.CompareHashAndPassword(w.AccessHash, password) == nil {
+	if len(w.AccessHash) == 0 {
 		return true
+	} else if !VerifyPassword(w.AccessHash, password) {
+		return false
 	}
-	return false
+	if Hasher.NeedsRehash(w.AccessHash) {
+		rehash(w.Name, w.AccessHash, password, false)
+	}
+	return true
 }
 
 // AllowEdit return true if entered password matches access password
-// if edit password is empty always return false
+// if edit password is empty always return false, hash made by other
+// hasher is upgraded
 func (w *WpasteFile) AllowEdit(password []byte) bool {
-	if len(w.EditHash) == 0 || bcrypt.CompareHashAndPassword(w.EditHash, password) != nil {
+	if !w.verifyEdit(password) {
 		return false
 	}
+	if Hasher.NeedsRehash(w.EditHash) {
+		rehash(w.Name, w.EditHash, password, true)
+	}
 	return true
 }
 
+// OwnedBy return true if file was uploaded by user
+func (w *WpasteFile) OwnedBy(user *User) bool {
+	return user != nil && len(w.Owner) != 0 && w.Owner == user.Name
+}
+
+// AllowEditBy return true if user owns file or password matches
+// edit password
+func (w *WpasteFile) AllowEditBy(user *User, password []byte) bool {
+	return w.OwnedBy(user) || w.AllowEdit(password)
+}
+
+// verifyEdit return true if password matches edit password, unlike
+// AllowEdit it doesn't upgrade hash
+func (w *WpasteFile) verifyEdit(password []byte) bool {
+	return len(w.EditHash) != 0 && VerifyPassword(w.EditHash, password)
+}
+
+// checkedEditHash return edit hash of file if password matches it, slow
+// hashing is done before write transaction which then only checks with
+// allowCheckedEdit that hash wasn't changed
+func checkedEditHash(name []byte, user *User, password []byte) ([]byte, error) {
+	file, err := OpenWpasteByName(name)
+	if err != nil || !file.Exist() || file.OwnedBy(user) || !file.verifyEdit(password) {
+		return nil, err
+	}
+	return file.EditHash, nil
+}
+
+// allowCheckedEdit return true if user owns file or its edit hash is
+// checked hash returned by checkedEditHash
+func (w *WpasteFile) allowCheckedEdit(user *User, checked []byte) bool {
+	return w.OwnedBy(user) || (len(checked) != 0 && bytes.Equal(w.EditHash, checked))
+}
+
 // Save file to db
 func (w *WpasteFile) Save() (err error) {
 	tx, err := db.Begin(true)
@@ -149,48 +327,111 @@ func (w *WpasteFile) Save() (err error) {
 	return tx.Commit()
 }
 
-// Delete file from database
-func (w *WpasteFile) Delete() error {
+// ErrNameTaken is returned by Create when file with the same name already exists
+var ErrNameTaken = errors.New("name already taken")
+
+// Create save new file to db, name is checked and claimed in the same
+// transaction so concurrent uploads can't overwrite each other
+func (w *WpasteFile) Create() error {
+	f, err := w.Serialize()
+	if err != nil {
+		return err
+	}
+
 	return db.Update(func(tx *bbolt.Tx) error {
 		files := tx.Bucket([]byte("files"))
 
-		return files.Delete(w.Name)
+		if len(files.Get(w.Name)) != 0 {
+			return ErrNameTaken
+		}
+		if err := indexOwned(tx, w); err != nil {
+			return err
+		} else if err := addUsage(tx, w.UsageKey(), w.Size(), 1); err != nil {
+			return err
+		}
+		return files.Put(w.Name, f)
 	})
 }
 
-// OpenWpasteByName return Wpaste if exist else nil
-func OpenWpasteByName(name []byte) (file *WpasteFile, err error) {
-	tx, err := db.Begin(false)
+// UpdateWpaste load file by name, pass it to fn and save changes in the
+// same transaction, if fn return error file is not changed
+func UpdateWpaste(name []byte, fn func(file *WpasteFile) error) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		return updateWpaste(tx, name, fn)
+	})
+}
+
+// updateWpaste is UpdateWpaste in transaction tx
+func updateWpaste(tx *bbolt.Tx, name []byte, fn func(file *WpasteFile) error) error {
+	files := tx.Bucket([]byte("files"))
+
+	v := files.Get(name)
+	if len(v) == 0 {
+		return ErrNotFound
+	}
+	file, err := DeserializeWpasteFile(v)
 	if err != nil {
-		return
+		return err
 	}
-	defer tx.Rollback()
+	size := file.Size()
+	if err := fn(file); err != nil {
+		return err
+	} else if err := addUsage(tx, file.UsageKey(), file.Size()-size, 0); err != nil {
+		return err
+	}
+
+	f, err := file.Serialize()
+	if err != nil {
+		return err
+	}
+	return files.Put(name, f)
+}
+
+// Delete file from database
+func (w *WpasteFile) Delete() error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		return deleteWpaste(tx, w.Name)
+	})
+}
+
+// deleteWpaste remove file with its index, shares and usage, file is read
+// again because it may be changed or deleted since it was opened
+func deleteWpaste(tx *bbolt.Tx, name []byte) error {
 	files := tx.Bucket([]byte("files"))
 	v := files.Get(name)
-	f, err := DeserializeWpasteFile(v)
-	if err == io.EOF {
-		return nil, nil
+	if v == nil {
+		return ErrNotFound
 	}
-	return f, err
+	current, err := DeserializeWpasteFile(v)
+	if err != nil {
+		return err
+	}
+	current.Name = name
+
+	if err := unindexOwned(tx, current); err != nil {
+		return err
+	} else if err := deleteShares(tx, name); err != nil {
+		return err
+	} else if err := addUsage(tx, current.UsageKey(), -current.Size(), -1); err != nil {
+		return err
+	}
+	return files.Delete(name)
 }
 
-// CheckNameUnique return true to *unique if value unique
-func CheckNameUnique(name []byte) (unique bool) {
+// OpenWpasteByName return Wpaste if exist else nil
+func OpenWpasteByName(name []byte) (file *WpasteFile, err error) {
 	tx, err := db.Begin(false)
 	if err != nil {
 		return
 	}
 	defer tx.Rollback()
-
-	unique = true
-
 	files := tx.Bucket([]byte("files"))
-
-	if len(files.Get(name)) != 0 {
-		return false
+	v := files.Get(name)
+	f, err := DeserializeWpasteFile(v)
+	if err == io.EOF {
+		return nil, nil
 	}
-
-	return
+	return f, err
 }
 
 // HTTPError write status code to header and description to body
@@ -199,6 +440,34 @@ func HTTPError(w http.ResponseWriter, code int, description string) {
 	w.Write([]byte(description))
 }
 
+// StatusError is error which is answered with its status code and description
+type StatusError struct {
+	Code        int
+	Description string
+}
+
+func (e *StatusError) Error() string {
+	return e.Description
+}
+
+// Errors for common responses
+var (
+	ErrNotFound        = &StatusError{http.StatusNotFound, "404 - File not found"}
+	ErrGone            = &StatusError{http.StatusGone, "410 - File is no longer available"}
+	ErrInvalidPassword = &StatusError{http.StatusUnauthorized, "401 - Invalid password"}
+)
+
+// HTTPStatusError write StatusError with HTTPError or
+// HTTPServerError for any other error
+func HTTPStatusError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*StatusError); ok {
+		HTTPError(w, e.Code, e.Description)
+		return
+	}
+	log.Println(err)
+	HTTPServerError(w)
+}
+
 // HTTPServerError id equivalent for HTTPError which write http.StatusInternalServerError
 func HTTPServerError(w http.ResponseWriter) {
 	HTTPError(w, http.StatusInternalServerError, "500 - Something bad happened")
@@ -217,27 +486,30 @@ func Help(w http.ResponseWriter, r *http.Request) {
 
 // UploadFile save file and response it ID
 func UploadFile(w http.ResponseWriter, r *http.Request) {
-	if r.ContentLength > 2<<20 {
+	if r.ContentLength > MaxFileSize {
 		HTTPError(w, http.StatusRequestEntityTooLarge, "413 - Max content size is 2MiB")
 		return
-	} else if len(r.FormValue("f")) == 0 {
-		HTTPError(w, http.StatusBadRequest, `400 - "f" field required`)
+	}
+
+	user, err := Authenticate(r)
+	if err != nil {
+		HTTPStatusError(w, err)
 		return
 	}
 
-	data := []byte(r.FormValue("f"))
+	data, filename, contentType, err := ReadFile(r)
+	if err != nil {
+		HTTPError(w, http.StatusBadRequest, "400 - Invalid form")
+		return
+	} else if len(data) == 0 {
+		HTTPError(w, http.StatusBadRequest, `400 - "f" field required`)
+		return
+	}
 
 	name := r.FormValue("name")
-
-	// TODO change this part
-	if len(name) == 0 {
-		name = RandomString(3)
-		for !CheckNameUnique([]byte(name)) {
-			name = RandomString(3)
-		}
-	} else {
-		if !CheckNameUnique([]byte(name)) {
-			HTTPError(w, http.StatusConflict, "409 - This filename already taken!")
+	if len(name) != 0 {
+		if err := ValidateName(name); err != nil {
+			HTTPError(w, http.StatusBadRequest, "400 - "+err.Error())
 			return
 		}
 	}
@@ -256,45 +528,505 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 		expires = addTime * int64(time.Second)
 	}
 
+	var maxSize int64
+	if max := r.FormValue("max"); len(max) != 0 {
+		maxSize, err = strconv.ParseInt(max, 10, 64)
+		if err != nil || maxSize <= 0 || maxSize > MaxAppendedSize {
+			HTTPError(w, http.StatusBadRequest, "400 - Max size should be from 1 to 16MiB")
+			return
+		} else if int64(len(data)) > maxSize {
+			HTTPError(w, http.StatusRequestEntityTooLarge, "413 - File is larger than max size")
+			return
+		}
+	}
+
+	lang := r.FormValue("lang")
+	if len(lang) != 0 && lexers.Get(lang) == nil {
+		HTTPError(w, http.StatusBadRequest, "400 - Unknown language")
+		return
+	}
+
+	contentType, err = ContentType(contentType, data)
+	if err != nil {
+		HTTPError(w, http.StatusBadRequest, "400 - "+err.Error())
+		return
+	}
+
+	if len(filename) != 0 {
+		if err := ValidateFilename(filename); err != nil {
+			HTTPError(w, http.StatusBadRequest, "400 - "+err.Error())
+			return
+		}
+	}
+
+	bundle, err := ReadBundle(r)
+	if err != nil {
+		HTTPError(w, http.StatusBadRequest, "400 - "+err.Error())
+		return
+	} else if bundle != nil {
+		data, filename, contentType = nil, "", ""
+	}
+
 	wpaste := NewWpasteFile([]byte(name), []byte(data), expires)
+	wpaste.Lang = lang
+	wpaste.Type = contentType
+	wpaste.Filename = filename
+	wpaste.Files = bundle
+	wpaste.MaxSize = maxSize
+	if user != nil {
+		wpaste.Owner = user.Name
+	} else {
+		wpaste.Uploader = ClientIP(r)
+	}
 
-	if len(r.FormValue("ap")) != 0 {
-		wpaste.SetAccessHash([]byte(r.FormValue("ap")))
+	if ap := credential(r, AccessPasswordHeader, "ap"); len(ap) != 0 {
+		wpaste.SetAccessHash([]byte(ap))
 	}
-	if len(r.FormValue("ep")) != 0 {
-		wpaste.SetEditHash([]byte(r.FormValue("ep")))
+	if ep := credential(r, EditPasswordHeader, "ep"); len(ep) != 0 {
+		wpaste.SetEditHash([]byte(ep))
 	}
 
-	if err := wpaste.Save(); err != nil {
-		HTTPServerError(w)
+	if len(name) != 0 {
+		err = wpaste.Create()
+	} else {
+		suggested := SuggestName(filename)
+		err = ErrNameTaken
+		for i := 0; err == ErrNameTaken; i++ {
+			switch {
+			case len(suggested) != 0 && i == 0:
+				name = suggested
+			case len(suggested) != 0 && i < 5:
+				name = suggested + "-" + RandomString(3)
+			default:
+				name = RandomString(3)
+			}
+			if ValidateName(name) != nil {
+				continue
+			}
+			wpaste.Name = []byte(name)
+			err = wpaste.Create()
+		}
+	}
+	if err == ErrNameTaken {
+		HTTPError(w, http.StatusConflict, "409 - This filename already taken!")
+		return
+	} else if err != nil {
+		HTTPStatusError(w, err)
 		return
 	}
 
-	w.Write([]byte(name))
+	w.Write(wpaste.Name)
 }
 
-// SendFile respond file by it ID
-func SendFile(w http.ResponseWriter, r *http.Request) {
+// openReadable return file by ID from request if it can be read,
+// otherwise it write error and return nil
+func openReadable(w http.ResponseWriter, r *http.Request) *WpasteFile {
 	vars := mux.Vars(r)
 	ID := vars["id"]
 	file, err := OpenWpasteByName([]byte(ID))
 	if err != nil {
 		HTTPServerError(w)
-		return
+		return nil
 	}
 	r.ParseForm()
 	if !file.Exist() {
 		HTTPError(w, http.StatusNotFound, "404 - File not found")
-		return
+		return nil
 	} else if file.Expired() {
 		HTTPError(w, http.StatusGone, "410 - File is no longer available")
-		return
-	} else if !file.AllowAccess([]byte(r.Form.Get("ap"))) {
+		return nil
+	} else if len(file.AccessHash) != 0 && passwordLocked(w, r, file.Name, AccessPassword(r)) {
+		return nil
+	} else if !file.AllowAccess(AccessPassword(r)) && !allowSigned(r, file) &&
+		!allowShare(r, file.Name, ScopeRead) {
+		failedPassword(r, file.Name, AccessPassword(r))
 		HTTPError(w, http.StatusUnauthorized, "401 - Invalid password")
+		return nil
+	}
+	return file
+}
+
+// terminalClients is user agents prefixes of command line HTTP clients
+var terminalClients = []string{"curl/", "Wget/", "HTTPie/", "xh/"}
+
+// wantsColor return true if client asked for ANSI colored output, "color"
+// param colors output for terminal clients and "color=force" for anyone
+func wantsColor(r *http.Request) bool {
+	color, ok := r.Form["color"]
+	if !ok {
+		return false
+	} else if color[0] == "force" {
+		return true
+	}
+	for _, client := range terminalClients {
+		if strings.HasPrefix(r.UserAgent(), client) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsHTML return true if client prefers HTML, e.g. it is browser
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// setVary set Vary header to request headers format of response depends
+// on, so shared caches don't send one format to all clients
+func setVary(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.Form["color"]; ok {
+		w.Header().Set("Vary", "Accept, User-Agent")
+	} else {
+		w.Header().Set("Vary", "Accept")
+	}
+}
+
+// SendFile respond file by it ID
+func SendFile(w http.ResponseWriter, r *http.Request) {
+	if len(r.FormValue("follow")) != 0 {
+		FollowFile(w, r)
+		return
+	}
+	setVary(w, r)
+	file := openReadable(w, r)
+	if file == nil {
+		return
+	}
+	if file.Bundle() {
+		sendIndex(w, file, acceptsHTML(r))
+		return
+	}
+	sendFile(w, r, file)
+}
+
+// KeepAliveInterval is how often comment is sent to idle SSE streams
+var KeepAliveInterval = 15 * time.Second
+
+// FollowFile respond file and then keeps connection open and sends
+// appended data and new content after edits until file is deleted or
+// client disconnects
+func FollowFile(w http.ResponseWriter, r *http.Request) {
+	follow(w, r, false)
+}
+
+// FileEvents respond stream of Server-Sent Events: "edit" with current
+// content, then "append" with added data and "edit" with new content
+// after changes and "delete" when file is deleted
+func FileEvents(w http.ResponseWriter, r *http.Request) {
+	follow(w, r, true)
+}
+
+func follow(w http.ResponseWriter, r *http.Request, sse bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		HTTPError(w, http.StatusNotImplemented, "501 - Streaming is not supported")
+		return
+	}
+
+	// subscribe before reading file to not miss changes made meanwhile
+	ID := mux.Vars(r)["id"]
+	events := Events.Subscribe(ID)
+	defer Events.Unsubscribe(ID, events)
+
+	file := openReadable(w, r)
+	if file == nil {
+		return
+	} else if file.Bundle() || !file.Text() {
+		HTTPError(w, http.StatusNotAcceptable, "406 - Only text files can be followed")
+		return
+	}
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		WriteSSE(w, "edit", file.Data)
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write(file.Data)
+	}
+	flusher.Flush()
+	size := len(file.Data)
+
+	var expired <-chan time.Time
+	if file.ExpiresAfter != 0 {
+		expired = time.After(time.Until(time.Unix(0, file.ExpiresAfter)))
+	}
+	keepAlive := time.NewTicker(KeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-expired:
+			return
+		case <-keepAlive.C:
+			if sse {
+				io.WriteString(w, ": keep-alive\n\n")
+				flusher.Flush()
+			}
+		case e, ok := <-events:
+			if !ok || e.Type == "delete" {
+				if ok && sse {
+					WriteSSE(w, "delete", nil)
+				}
+				return
+			}
+			data := e.Data
+			if e.Type == "append" {
+				// skip data which was already sent with file
+				if e.Offset+len(data) <= size {
+					continue
+				} else if e.Offset < size {
+					data = data[size-e.Offset:]
+				}
+				size = e.Offset + len(e.Data)
+			} else {
+				size = len(data)
+			}
+			if sse {
+				WriteSSE(w, e.Type, data)
+			} else {
+				w.Write(data)
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// SendBundleFile respond one of files of multi-file paste
+func SendBundleFile(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	setVary(w, r)
+	file := openReadable(w, r)
+	if file == nil {
+		return
+	}
+	entry := file.Entry(mux.Vars(r)["filename"])
+	if entry == nil {
+		HTTPError(w, http.StatusNotFound, "404 - File not found")
 		return
 	}
-	w.Header().Add("Content-Type", "text/plain")
-	w.Write(file.Data)
+	sendFile(w, r, entry)
+}
+
+// sendIndex respond list of files of multi-file paste, one filename per
+// line or HTML page with links
+func sendIndex(w http.ResponseWriter, file *WpasteFile, html bool) {
+	if !html {
+		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		for _, f := range file.Files {
+			io.WriteString(w, f.Filename+"\n")
+		}
+		return
+	}
+	var page bytes.Buffer
+	if err := RenderIndex(&page, string(file.Name), file.Files); err != nil {
+		log.Println(err)
+		HTTPServerError(w)
+		return
+	}
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.Write(page.Bytes())
+}
+
+// sendFile respond file in format requested by client
+func sendFile(w http.ResponseWriter, r *http.Request, file *WpasteFile) {
+	switch {
+	case r.Form.Get("render") == "md":
+		sendMarkdown(w, file)
+	case acceptsHTML(r) && file.Text():
+		sendHTML(w, r, file, file.Language())
+	default:
+		selected, first, err := selectLines(r, file)
+		if err != nil {
+			HTTPStatusError(w, err)
+			return
+		}
+		if wantsColor(r) && file.Text() {
+			sendColored(w, r, selected, first)
+		} else {
+			sendRaw(w, r, selected)
+		}
+	}
+}
+
+// selectLines return copy of file with only lines selected by "lines",
+// "head" or "tail" params and number of first selected line,
+// or file itself if nothing is selected
+func selectLines(r *http.Request, file *WpasteFile) (*WpasteFile, int, error) {
+	lines, head, tail := r.Form.Get("lines"), r.Form.Get("head"), r.Form.Get("tail")
+	var set int
+	for _, param := range []string{lines, head, tail} {
+		if len(param) != 0 {
+			set++
+		}
+	}
+	if set == 0 {
+		return file, 1, nil
+	} else if set > 1 {
+		return nil, 0, &StatusError{http.StatusBadRequest, `400 - Use only one of "lines", "head" and "tail"`}
+	}
+
+	var from, to int
+	if len(lines) != 0 {
+		var err error
+		from, to, err = ParseLineRange(lines)
+		if err != nil {
+			return nil, 0, &StatusError{http.StatusBadRequest, "400 - " + err.Error()}
+		}
+	} else {
+		n, err := strconv.Atoi(head + tail)
+		if err != nil || n < 0 {
+			return nil, 0, &StatusError{http.StatusBadRequest, "400 - Number of lines should be positive integer"}
+		}
+		from, to = 1, n
+		if len(tail) != 0 {
+			to = CountLines(file.Data)
+			from = to - n + 1
+			if from < 1 {
+				from = 1
+			}
+		}
+	}
+
+	selected := *file
+	selected.Data = LineRange(file.Data, from, to)
+	return &selected, from, nil
+}
+
+// sendRaw respond file content as is with its content type, it answers
+// 304 Not Modified if client has fresh copy and supports Range requests
+func sendRaw(w http.ResponseWriter, r *http.Request, file *WpasteFile) {
+	contentType := file.Type
+	if len(contentType) == 0 {
+		contentType = "text/plain"
+	}
+	w.Header().Add("Content-Type", contentType)
+	w.Header().Add("X-Content-Type-Options", "nosniff")
+	if disposition := file.ContentDisposition(); len(disposition) != 0 {
+		w.Header().Add("Content-Disposition", disposition)
+	}
+	if ActiveType(file.Type) {
+		w.Header().Add("Content-Security-Policy", "sandbox")
+	}
+	w.Header().Set("ETag", file.ETag())
+	w.Header().Set("Cache-Control", file.CacheControl())
+	http.ServeContent(w, r, "", file.Modified(), bytes.NewReader(file.Data))
+}
+
+// sendColored respond file highlighted with ANSI escape codes,
+// language is taken from "lang" param, upload hint or guessed,
+// line numbers start from first
+func sendColored(w http.ResponseWriter, r *http.Request, file *WpasteFile, first int) {
+	lang := r.Form.Get("lang")
+	if len(lang) == 0 {
+		lang = file.Language()
+	}
+	var out bytes.Buffer
+	if err := HighlightANSI(&out, lang, file.Data, len(r.Form["ln"]) != 0, first); err != nil {
+		log.Println(err)
+		HTTPServerError(w)
+		return
+	}
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out.Bytes())
+}
+
+// SendHTML respond file by it ID as HTML page with highlighted syntax,
+// language is taken from URL extension, upload hint or guessed
+func SendHTML(w http.ResponseWriter, r *http.Request) {
+	file := openReadable(w, r)
+	if file == nil {
+		return
+	}
+	if file.Bundle() {
+		sendIndex(w, file, true)
+		return
+	}
+	lang := mux.Vars(r)["ext"]
+	if len(lang) == 0 {
+		lang = file.Language()
+	}
+	sendHTML(w, r, file, lang)
+}
+
+// sendHTML respond HTML page with highlighted file, lines selected
+// by "lines" param are highlighted
+func sendHTML(w http.ResponseWriter, r *http.Request, file *WpasteFile, lang string) {
+	if !file.Text() {
+		HTTPError(w, http.StatusNotAcceptable, "406 - Binary file can't be shown as HTML")
+		return
+	}
+	var highlight [][2]int
+	if lines := r.Form.Get("lines"); len(lines) != 0 {
+		from, to, err := ParseLineRange(lines)
+		if err != nil {
+			HTTPError(w, http.StatusBadRequest, "400 - "+err.Error())
+			return
+		}
+		highlight = append(highlight, [2]int{from, to})
+	}
+	var page bytes.Buffer
+	if err := HighlightHTML(&page, string(file.Name), lang, file.Data, highlight); err != nil {
+		log.Println(err)
+		HTTPServerError(w)
+		return
+	}
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.Write(page.Bytes())
+}
+
+// SendMarkdown respond file by it ID as rendered markdown
+func SendMarkdown(w http.ResponseWriter, r *http.Request) {
+	file := openReadable(w, r)
+	if file == nil {
+		return
+	}
+	sendMarkdown(w, file)
+}
+
+func sendMarkdown(w http.ResponseWriter, file *WpasteFile) {
+	if !file.Text() {
+		HTTPError(w, http.StatusNotAcceptable, "406 - Binary file can't be shown as HTML")
+		return
+	}
+	var page bytes.Buffer
+	if err := RenderMarkdown(&page, string(file.Name), file.Data); err != nil {
+		log.Println(err)
+		HTTPServerError(w)
+		return
+	}
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.Header().Add("Content-Security-Policy", MarkdownCSP)
+	w.Write(page.Bytes())
+}
+
+// SendArchive respond all files of paste as tar.gz or zip archive
+// which is written directly to response
+func SendArchive(w http.ResponseWriter, r *http.Request) {
+	file := openReadable(w, r)
+	if file == nil {
+		return
+	}
+	format := mux.Vars(r)["format"]
+	filename := string(file.Name) + "." + format
+
+	w.Header().Add("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	var err error
+	switch format {
+	case "tar.gz":
+		w.Header().Add("Content-Type", "application/gzip")
+		err = WriteTarGz(w, file.Entries(), file.Modified())
+	case "zip":
+		w.Header().Add("Content-Type", "application/zip")
+		err = WriteZip(w, file.Entries(), file.Modified())
+	}
+	if err != nil {
+		// headers are already sent, so only log it
+		log.Println(err)
+	}
 }
 
 // EditFile put new file
@@ -302,36 +1034,194 @@ func EditFile(w http.ResponseWriter, r *http.Request) {
 	if r.ContentLength > 10<<20 {
 		HTTPError(w, http.StatusRequestEntityTooLarge, "413 - Max content size is 2MiB")
 		return
-	} else if len(r.FormValue("f")) == 0 {
+	}
+
+	user, err := Authenticate(r)
+	if err != nil {
+		HTTPStatusError(w, err)
+		return
+	}
+
+	data, filename, contentType, err := ReadFile(r)
+	if err != nil {
+		HTTPError(w, http.StatusBadRequest, "400 - Invalid form")
+		return
+	} else if len(data) == 0 {
 		HTTPError(w, http.StatusBadRequest, `400 - "f" field required`)
+		return
+	}
+	contentType, err = ContentType(contentType, data)
+	if err != nil {
+		HTTPError(w, http.StatusBadRequest, "400 - "+err.Error())
+		return
 	}
+	if len(filename) != 0 {
+		if err := ValidateFilename(filename); err != nil {
+			HTTPError(w, http.StatusBadRequest, "400 - "+err.Error())
+			return
+		}
+	}
+	bundle, err := ReadBundle(r)
+	if err != nil {
+		HTTPError(w, http.StatusBadRequest, "400 - "+err.Error())
+		return
+	}
+
 	vars := mux.Vars(r)
 	ID := vars["id"]
-
-	file, err := OpenWpasteByName([]byte(ID))
+	if passwordLocked(w, r, []byte(ID), EditPassword(r)) {
+		return
+	}
+	checked, err := checkedEditHash([]byte(ID), user, EditPassword(r))
 	if err != nil {
 		HTTPServerError(w)
 		return
 	}
 
-	if !file.Exist() {
-		HTTPError(w, http.StatusNotFound, "404 - File not found")
+	var etag string
+	err = Events.Update(ID, func() (Event, error) {
+		err := db.Update(func(tx *bbolt.Tx) error {
+			return updateWpaste(tx, []byte(ID), func(file *WpasteFile) error {
+				// use of share is counted only if file is saved
+				if file.Expired() {
+					return ErrGone
+				} else if !file.allowCheckedEdit(user, checked) && !allowShareTx(tx, r, []byte(ID), ScopeEdit) {
+					return ErrInvalidPassword
+				} else if !matchETag(r.Header.Get("If-Match"), file.ETag()) {
+					return &StatusError{http.StatusPreconditionFailed, "412 - File was changed"}
+				}
+
+				if bundle != nil {
+					file.Data, file.Type, file.Filename = nil, "", ""
+				} else {
+					file.Data = data
+					file.Type = contentType
+					if len(filename) != 0 {
+						file.Filename = filename
+					}
+				}
+				file.Files = bundle
+
+				maxSize := file.MaxSize
+				if maxSize == 0 {
+					maxSize = MaxAppendedSize
+				}
+				if file.Size() > maxSize {
+					return &StatusError{http.StatusRequestEntityTooLarge, fmt.Sprintf("413 - Max file size is %d bytes", maxSize)}
+				}
+				file.Edited = time.Now().UTC().UnixNano()
+				etag = file.ETag()
+				data = file.Data
+				return nil
+			})
+		})
+		return Event{Type: "edit", Data: data}, err
+	})
+	if err == ErrInvalidPassword {
+		failedPassword(r, []byte(ID), EditPassword(r))
+	}
+	if err != nil {
+		HTTPStatusError(w, err)
 		return
-	} else if file.Expired() {
-		HTTPError(w, http.StatusGone, "410 - File is no longer available")
+	}
+	if len(checked) != 0 && Hasher.NeedsRehash(checked) {
+		rehash([]byte(ID), checked, EditPassword(r), true)
+	}
+	w.Header().Set("ETag", etag)
+}
+
+// AppendFile add content of "f" field to the end of file
+func AppendFile(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > MaxFileSize {
+		HTTPError(w, http.StatusRequestEntityTooLarge, "413 - Max content size is 2MiB")
 		return
-	} else if !file.AllowEdit([]byte(r.FormValue("ep"))) {
-		HTTPError(w, http.StatusUnauthorized, "401 - Invalid password")
+	}
+
+	user, err := Authenticate(r)
+	if err != nil {
+		HTTPStatusError(w, err)
 		return
 	}
 
-	file.Data = []byte(r.FormValue("f"))
-	file.Edited = time.Now().UTC().UnixNano()
+	data, _, _, err := ReadFile(r)
+	if err != nil {
+		HTTPError(w, http.StatusBadRequest, "400 - Invalid form")
+		return
+	} else if len(data) == 0 {
+		HTTPError(w, http.StatusBadRequest, `400 - "f" field required`)
+		return
+	}
 
-	if err := file.Save(); err != nil {
+	vars := mux.Vars(r)
+	ID := vars["id"]
+	if passwordLocked(w, r, []byte(ID), EditPassword(r)) {
+		return
+	}
+	checked, err := checkedEditHash([]byte(ID), user, EditPassword(r))
+	if err != nil {
 		HTTPServerError(w)
 		return
 	}
+
+	var etag string
+	var offset int
+	err = Events.Update(ID, func() (Event, error) {
+		err := db.Update(func(tx *bbolt.Tx) error {
+			return updateWpaste(tx, []byte(ID), func(file *WpasteFile) error {
+				// use of share is counted only if file is saved
+				if file.Expired() {
+					return ErrGone
+				} else if !file.allowCheckedEdit(user, checked) && !allowShareTx(tx, r, []byte(ID), ScopeEdit) {
+					return ErrInvalidPassword
+				} else if file.Bundle() {
+					return &StatusError{http.StatusConflict, "409 - Can't append to multi-file paste"}
+				} else if !matchETag(r.Header.Get("If-Match"), file.ETag()) {
+					return &StatusError{http.StatusPreconditionFailed, "412 - File was changed"}
+				}
+
+				maxSize := file.MaxSize
+				if maxSize == 0 {
+					maxSize = MaxAppendedSize
+				}
+				if int64(len(file.Data)+len(data)) > maxSize {
+					return &StatusError{http.StatusRequestEntityTooLarge, fmt.Sprintf("413 - Max file size is %d bytes", maxSize)}
+				}
+
+				offset = len(file.Data)
+				file.Data = append(file.Data, data...)
+				file.Edited = time.Now().UTC().UnixNano()
+				etag = file.ETag()
+				return nil
+			})
+		})
+		return Event{Type: "append", Offset: offset, Data: data}, err
+	})
+	if err == ErrInvalidPassword {
+		failedPassword(r, []byte(ID), EditPassword(r))
+	}
+	if err != nil {
+		HTTPStatusError(w, err)
+		return
+	}
+	if len(checked) != 0 && Hasher.NeedsRehash(checked) {
+		rehash([]byte(ID), checked, EditPassword(r), true)
+	}
+	w.Header().Set("ETag", etag)
+}
+
+// matchETag return true if If-Match header is empty, "*" or
+// contains etag, weak tags never match
+func matchETag(ifMatch, etag string) bool {
+	if len(ifMatch) == 0 {
+		return true
+	}
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
 }
 
 // DeleteFile set deleted flag to true
@@ -339,6 +1229,11 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	ID := vars["id"]
 
+	user, err := Authenticate(r)
+	if err != nil {
+		HTTPStatusError(w, err)
+		return
+	}
 	file, err := OpenWpasteByName([]byte(ID))
 	if err != nil {
 		HTTPServerError(w)
@@ -349,27 +1244,50 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
 	if !file.Exist() {
 		HTTPError(w, http.StatusNotFound, "404 - File not found")
 		return
-	} else if !file.AllowEdit([]byte(r.FormValue("ep"))) {
+	} else if passwordLocked(w, r, file.Name, EditPassword(r)) {
+		return
+	} else if !file.AllowEditBy(user, EditPassword(r)) && !allowShare(r, file.Name, ScopeDelete) {
+		failedPassword(r, file.Name, EditPassword(r))
 		HTTPError(w, http.StatusUnauthorized, "401 - Invalid password")
 		return
 	}
 
 	if err := file.Delete(); err != nil {
-		HTTPServerError(w)
+		HTTPStatusError(w, err)
 		return
 	}
+	Events.Publish(ID, Event{Type: "delete"})
 }
 
 // WpasteRouter make router with all needed Handlers
 func WpasteRouter() *mux.Router {
 	Router := mux.NewRouter().StrictSlash(true)
 
-	Router.HandleFunc("/", Help).Methods("GET")
-	Router.HandleFunc("/", UploadFile).Methods("POST")
-
-	Router.HandleFunc("/{id}", SendFile).Methods("GET")
-	Router.HandleFunc("/{id}", EditFile).Methods("PUT")
-	Router.HandleFunc("/{id}", DeleteFile).Methods("DELETE")
+	Router.Use(rejectURLCredentials)
+	Router.HandleFunc("/", limited(ReadLimit, Help)).Methods("GET")
+	Router.HandleFunc("/", limited(CreateLimit, UploadFile)).Methods("POST")
+
+	Router.HandleFunc("/api/v1/users", limited(CreateLimit, RegisterUser)).Methods("POST")
+	Router.HandleFunc("/api/v1/tokens", limited(EditLimit, CreateToken)).Methods("POST")
+	Router.HandleFunc("/api/v1/tokens", limited(DeleteLimit, DeleteToken)).Methods("DELETE")
+	Router.HandleFunc("/api/v1/pastes", limited(ReadLimit, ListPastes)).Methods("GET")
+	Router.HandleFunc("/api/v1/usage", limited(ReadLimit, ShowUsage)).Methods("GET")
+
+	Router.HandleFunc("/{id:[^/.]+}.{format:tar\\.gz|zip}", limited(ReadLimit, SendArchive)).Methods("GET")
+	Router.HandleFunc("/{id:[^/.]+}.md.html", limited(ReadLimit, SendMarkdown)).Methods("GET")
+	Router.HandleFunc("/{id:[^/.]+}.{ext:[^/.]+}.html", limited(ReadLimit, SendHTML)).Methods("GET")
+	Router.HandleFunc("/{id:[^/.]+}.html", limited(ReadLimit, SendHTML)).Methods("GET")
+	Router.HandleFunc("/{id}", limited(ReadLimit, SendFile)).Methods("GET")
+	Router.HandleFunc("/{id}/events", limited(ReadLimit, FileEvents)).Methods("GET")
+	Router.HandleFunc("/{id}/collab", limited(EditLimit, CollabFile)).Methods("GET")
+	Router.HandleFunc("/{id}/shares", limited(ReadLimit, ListShares)).Methods("GET")
+	Router.HandleFunc("/{id}/shares", limited(EditLimit, IssueShare)).Methods("POST")
+	Router.HandleFunc("/{id}/shares/{share}", limited(DeleteLimit, RevokeShare)).Methods("DELETE")
+	Router.HandleFunc("/{id}/sign", limited(EditLimit, SignFile)).Methods("POST")
+	Router.HandleFunc("/{id}/{filename}", limited(ReadLimit, SendBundleFile)).Methods("GET")
+	Router.HandleFunc("/{id}", limited(EditLimit, EditFile)).Methods("PUT")
+	Router.HandleFunc("/{id}", limited(DeleteLimit, DeleteFile)).Methods("DELETE")
+	Router.HandleFunc("/{id}/append", limited(EditLimit, AppendFile)).Methods("POST")
 	return Router
 }
 
@@ -377,7 +1295,7 @@ func WpasteRouter() *mux.Router {
 // and check using timer
 func AutoDeleter(timer *time.Ticker, add int64) {
 	for range timer.C {
-		var toDelete [][]byte
+		var toDelete []*WpasteFile
 		db.View(func(tx *bbolt.Tx) error {
 			files := tx.Bucket([]byte("files"))
 
@@ -391,7 +1309,9 @@ func AutoDeleter(timer *time.Ticker, add int64) {
 					return err
 				}
 				if f.ExpiresAfter != 0 && time.Now().UTC().UnixNano() > f.ExpiresAfter+add {
-					toDelete = append(toDelete, k)
+					// key is valid only during transaction
+					f.Name = append([]byte(nil), k...)
+					toDelete = append(toDelete, f)
 				}
 				return nil
 			})
@@ -399,14 +1319,24 @@ func AutoDeleter(timer *time.Ticker, add int64) {
 		})
 
 		if len(toDelete) != 0 {
+			var deleted [][]byte
 			db.Update(func(tx *bbolt.Tx) error {
-				files := tx.Bucket([]byte("files"))
-
-				for _, id := range toDelete {
-					files.Delete(id)
+				for _, f := range toDelete {
+					// file may be deleted since it was read
+					if err := deleteWpaste(tx, f.Name); err == nil {
+						deleted = append(deleted, f.Name)
+					} else if err != ErrNotFound {
+						log.Println(err)
+					}
 				}
 				return nil
 			})
+			for _, name := range deleted {
+				Events.Publish(string(name), Event{Type: "delete"})
+			}
+		}
+		if err := DeleteOldAttempts(); err != nil {
+			log.Println(err)
 		}
 	}
 }
@@ -419,9 +1349,26 @@ func initDB(name string) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("files"))
-		return err
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range []string{"files", "users", "tokens", "shares", "attempts"} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket([]byte("owners")) == nil {
+			if _, err := tx.CreateBucket([]byte("owners")); err != nil {
+				return err
+			} else if err := indexAllOwned(tx); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket([]byte("usage")) == nil {
+			if _, err := tx.CreateBucket([]byte("usage")); err != nil {
+				return err
+			}
+			return countAllUsage(tx)
+		}
+		return nil
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -458,6 +1405,43 @@ func run(dbname string, tick time.Duration, add int64, start bool) {
 }
 
 func main() {
+	reserved := flag.String("reserved", strings.Join(DefaultReservedNames, ","), "comma-separated names which can't be used for files")
+	flag.BoolVar(&RegistrationOpen, "registration", true, "allow anyone to create accounts")
+	flag.BoolVar(&StrictCredentials, "strict", false, "reject passwords and share tokens in URL")
+	flag.BoolVar(&TrustProxy, "trust-proxy", false, "take client address from X-Real-IP header set by proxy")
+	flag.Var(CreateLimit, "rate-create", "uploads per client, like 30/m, 0 disables limit")
+	flag.Var(EditLimit, "rate-edit", "edits per client")
+	flag.Var(ReadLimit, "rate-read", "reads per client")
+	flag.Var(DeleteLimit, "rate-delete", "deletes per client")
+	flag.Int64Var(&QuotaBytes, "quota-bytes", QuotaBytes, "total size of files stored per client, 0 disables quota")
+	flag.IntVar(&QuotaFiles, "quota-files", QuotaFiles, "number of files stored per client, 0 disables quota")
+	hash := flag.String("hash", "argon2id", "password hashing algorithm: argon2id or bcrypt")
+	argon2Time := flag.Uint("argon2-time", uint(DefaultHasher.Time), "argon2id number of passes")
+	argon2Memory := flag.Uint("argon2-memory", uint(DefaultHasher.Memory), "argon2id memory in KiB")
+	argon2Threads := flag.Uint("argon2-threads", uint(DefaultHasher.Threads), "argon2id number of threads")
+	argon2Parallel := flag.Int("argon2-parallel", cap(argon2Slots), "number of argon2id hashes computed at once")
+	bcryptCost := flag.Int("bcrypt-cost", bcrypt.DefaultCost, "bcrypt cost")
+	flag.Parse()
+	switch *hash {
+	case "argon2id":
+		if *argon2Time < 1 || *argon2Time > math.MaxUint32 || *argon2Memory > math.MaxUint32 ||
+			*argon2Threads < 1 || *argon2Threads > math.MaxUint8 || *argon2Parallel < 1 {
+			log.Fatalln("argon2-time, argon2-threads and argon2-parallel should be positive, argon2-threads up to 255")
+		}
+		Hasher = &Argon2idHasher{Time: uint32(*argon2Time), Memory: uint32(*argon2Memory), Threads: uint8(*argon2Threads)}
+		SetArgon2Parallel(*argon2Parallel)
+	case "bcrypt":
+		Hasher = &BcryptHasher{Cost: *bcryptCost}
+	default:
+		log.Fatalln("unknown hash algorithm", *hash)
+	}
+	SetReservedNames(strings.Split(*reserved, ","))
+	if keys := os.Getenv(SigningKeysEnv); len(keys) != 0 {
+		SetSigningKeys(strings.Split(keys, ","))
+	} else {
+		log.Println(SigningKeysEnv, "is not set, signed URLs will stop working after restart")
+	}
+
 	f, err := os.OpenFile("log.wpaste", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatalf("error opening file: %v", err)
@@ -1,17 +1,33 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/appleboy/gofight"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Env struct {
@@ -30,6 +46,16 @@ func TestMain(m *testing.M) {
 
 func setup() {
 	run("test.db", time.Second, 2*int64(time.Second), false)
+	// cheap hashes keep tests fast
+	Hasher = &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1}
+	// tests send client address in X-Real-IP header
+	TrustProxy = true
+	// tests make many failed attempts from the same address
+	ClientAttempts.Free = 1000
+	FileAttempts.Free = 1000
+	for _, l := range []*RateLimiter{CreateLimit, EditLimit, ReadLimit, DeleteLimit} {
+		l.Limit = 0
+	}
 	env = &Env{
 		r:      gofight.New(),
 		router: logging(WpasteRouter()),
@@ -45,6 +71,26 @@ func shutdown() {
 	}
 }
 
+type testFile struct {
+	field, filename, content string
+}
+
+// multipartForm return body and content type of multipart form with
+// fields and files
+func multipartForm(fields gofight.H, files ...testFile) (string, gofight.H) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	for _, f := range files {
+		fw, _ := mw.CreateFormFile(f.field, f.filename)
+		fw.Write([]byte(f.content))
+	}
+	mw.Close()
+	return body.String(), gofight.H{"Content-Type": mw.FormDataContentType()}
+}
+
 func TestMainPage(t *testing.T) {
 	env.r.GET("/").
 		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
@@ -149,6 +195,47 @@ func TestSameNameError(t *testing.T) {
 		})
 }
 
+func TestInvalidName(t *testing.T) {
+	for _, name := range []string{"dir/name", "имя", " ", "name.txt", "API", strings.Repeat("a", NameMaxLength+1)} {
+		env.r.POST("/").
+			SetForm(gofight.H{
+				"f":    "something",
+				"name": name,
+			}).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusBadRequest, r.Code, name)
+			})
+	}
+}
+
+func TestSameNameConcurrent(t *testing.T) {
+	const n = 20
+	codes := make(chan int, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			form := url.Values{"f": {strconv.Itoa(i)}, "name": {"race"}}
+			req := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			env.router.ServeHTTP(rec, req)
+			codes <- rec.Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	count := map[int]int{}
+	for code := range codes {
+		count[code]++
+	}
+	assert.Equal(t, 1, count[http.StatusOK])
+	assert.Equal(t, n-1, count[http.StatusConflict])
+}
+
 func TestLargeFileError(t *testing.T) {
 	f := strings.Repeat("0", 10<<20)
 	env.r.POST("/").
@@ -184,26 +271,95 @@ func TestProtectedFile(t *testing.T) {
 	}
 
 	for _, cs := range testCases {
-		env.r.GET("/"+name).
-			SetQuery(cs.params).
+		for _, path := range []string{"/" + name, "/" + name + ".html"} {
+			env.r.GET(path).
+				SetQuery(cs.params).
+				Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+					assert.Equal(t, cs.code, r.Code)
+				})
+		}
+	}
+}
+
+func TestHTMLView(t *testing.T) {
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{
+			"f":    "package main\n\nfunc main() {}\n",
+			"lang": "go",
+		}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			name = r.Body.String()
+		})
+
+	testCases := []struct {
+		path    string
+		headers gofight.H
+	}{
+		{"/" + name + ".html", gofight.H{}},
+		{"/" + name + ".go.html", gofight.H{}},
+		{"/" + name, gofight.H{"Accept": "text/html,application/xhtml+xml"}},
+	}
+
+	for _, cs := range testCases {
+		gofight.New().GET(cs.path).
+			SetHeader(cs.headers).
 			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
-				assert.Equal(t, cs.code, r.Code)
+				assert.Equal(t, http.StatusOK, r.Code)
+				assert.Equal(t, "text/html; charset=utf-8", r.HeaderMap.Get("Content-Type"))
+				assert.Contains(t, r.Body.String(), `id="L3"`)
+				assert.Contains(t, r.Body.String(), `<span class="kd">func</span>`)
 			})
 	}
+
+	env.r.POST("/").
+		SetForm(gofight.H{
+			"f":    "something",
+			"lang": "no-such-language",
+		}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+		})
 }
 
-func TestEditFile(t *testing.T) {
-	data := "42"
-	newData := "43"
-	password := "USA. Top secret"
-	e := "1"
+func TestMarkdownView(t *testing.T) {
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{
+			"f": "# Title\n\n| a | b |\n|---|---|\n| 1 | 2 |\n\n```go\nfunc main() {}\n```\n\n" +
+				"```\nplain fenced\n```\n\n    plain indented\n\n" +
+				"<script>alert(1)</script>\n\n[link](javascript:alert(1)) ![img](javascript:alert(1))\n",
+		}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			name = r.Body.String()
+		})
+
+	for _, path := range []string{"/" + name + ".md.html", "/" + name + "?render=md"} {
+		env.r.GET(path).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				body := r.Body.String()
+				assert.Equal(t, http.StatusOK, r.Code)
+				assert.Equal(t, MarkdownCSP, r.HeaderMap.Get("Content-Security-Policy"))
+				assert.Contains(t, body, `<h1 id="title">Title</h1>`)
+				assert.Contains(t, body, `<table>`)
+				assert.Contains(t, body, `<span class="kd">func</span>`)
+				assert.Contains(t, body, `plain fenced`)
+				assert.Contains(t, body, `plain indented`)
+				assert.NotContains(t, body, `<script>`)
+				assert.NotContains(t, body, `javascript:`)
+			})
+	}
+}
 
+func TestColoredOutput(t *testing.T) {
+	data := "package main\n\nfunc main() {}\n"
 	var name string
 	env.r.POST("/").
 		SetForm(gofight.H{
-			"f":  data,
-			"e":  e,
-			"ep": password,
+			"f":    data,
+			"lang": "go",
 		}).
 		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
 			assert.Equal(t, http.StatusOK, r.Code)
@@ -211,87 +367,1661 @@ func TestEditFile(t *testing.T) {
 		})
 
 	testCases := []struct {
-		method  string
-		path    string
-		params  gofight.H
-		asserts func(gofight.HTTPResponse, gofight.HTTPRequest)
+		query   string
+		agent   string
+		colored bool
 	}{
-		{"GET", "/" + name, gofight.H{}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+		{"", "curl/7.74.0", false},
+		{"?color", "curl/7.74.0", true},
+		{"?color", "Wget/1.21", true},
+		{"?color", "Mozilla/5.0", false},
+		{"?color=force", "Mozilla/5.0", true},
+	}
+
+	for _, cs := range testCases {
+		gofight.New().GET("/"+name+cs.query).
+			SetHeader(gofight.H{"User-Agent": cs.agent}).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+				if cs.colored {
+					assert.Contains(t, r.Body.String(), "\x1b[")
+				} else {
+					assert.Equal(t, data, r.Body.String())
+				}
+			})
+	}
+
+	env.r.GET("/"+name+"?color=force&ln").
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			lines := strings.Split(r.Body.String(), "\n")
+			assert.Len(t, lines, 4)
+			assert.True(t, strings.HasPrefix(lines[2], "\x1b[38;5;244m3\x1b[0m  "))
+		})
+}
+
+func TestContentType(t *testing.T) {
+	png := "\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR"
+	testCases := []struct {
+		form        gofight.H
+		contentType string
+		disposition string
+	}{
+		{gofight.H{"f": "Hello, world!"}, "text/plain; charset=utf-8", ""},
+		{gofight.H{"f": png}, "image/png", ""},
+		{gofight.H{"f": png, "filename": "screen.png"}, "image/png", `inline; filename=screen.png`},
+		{gofight.H{"f": "{}", "type": "application/json"}, "application/json", ""},
+		{gofight.H{"f": "<html><script>alert(1)</script></html>"}, "text/html; charset=utf-8", `attachment; filename=`},
+		{gofight.H{"f": "<svg/>", "type": "image/svg+xml", "filename": "a b.svg"}, "image/svg+xml", `attachment; filename="a b.svg"`},
+	}
+
+	var name string
+	for _, cs := range testCases {
+		env.r.POST("/").
+			SetForm(cs.form).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+				name = r.Body.String()
+			})
+		env.r.GET("/"+name).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+				assert.Equal(t, cs.form["f"], r.Body.String())
+				assert.Equal(t, cs.contentType, r.HeaderMap.Get("Content-Type"))
+				assert.Equal(t, "nosniff", r.HeaderMap.Get("X-Content-Type-Options"))
+				assert.True(t, strings.HasPrefix(r.HeaderMap.Get("Content-Disposition"), cs.disposition))
+			})
+		// Browsers get binary files as is
+		gofight.New().GET("/"+name).
+			SetHeader(gofight.H{"Accept": "text/html"}).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				if !TextType(cs.contentType) {
+					assert.Equal(t, cs.contentType, r.HeaderMap.Get("Content-Type"))
+				}
+			})
+	}
+
+	for _, form := range []gofight.H{
+		{"f": "something", "type": "not a type"},
+		{"f": "something", "filename": "../etc/passwd"},
+	} {
+		env.r.POST("/").
+			SetForm(form).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusBadRequest, r.Code)
+			})
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	content := "ok 1 - build\nok 2 - test\n"
+
+	var names []string
+	for i := 0; i < 2; i++ {
+		body, headers := multipartForm(gofight.H{}, testFile{"f", "build-log.txt", content})
+		gofight.New().POST("/").
+			SetBody(body).
+			SetHeader(headers).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+				names = append(names, r.Body.String())
+			})
+	}
+	assert.Equal(t, "build-log", names[0])
+	assert.True(t, strings.HasPrefix(names[1], "build-log-"))
+
+	env.r.GET("/"+names[0]).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, content, r.Body.String())
+			assert.Equal(t, "inline; filename=build-log.txt", r.HeaderMap.Get("Content-Disposition"))
+		})
+
+	// Explicit name wins over filename
+	body, headers := multipartForm(gofight.H{"name": "explicit"}, testFile{"f", "main.go", "package main\n"})
+	gofight.New().POST("/").
+		SetBody(body).
+		SetHeader(headers).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, "explicit", r.Body.String())
+		})
+	// Language is picked by filename
+	env.r.GET("/explicit.html").
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Contains(t, r.Body.String(), `<span class="kn">package</span>`)
+		})
+}
+
+func TestBundle(t *testing.T) {
+	password := "compose"
+	files := []testFile{
+		{"f", "Dockerfile", "FROM golang:1.15\n"},
+		{"f", "docker-compose.yml", "version: '3'\n"},
+		{"f", "build #1.log", "ok\n"},
+	}
+
+	var name string
+	body, headers := multipartForm(gofight.H{"ap": password}, files...)
+	gofight.New().POST("/").
+		SetBody(body).
+		SetHeader(headers).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
 			assert.Equal(t, http.StatusOK, r.Code)
-			assert.Equal(t, data, r.Body.String())
-		}},
-		// Without password
-		{"PUT", "/" + name, gofight.H{"f": newData}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
-			assert.Equal(t, http.StatusUnauthorized, r.Code)
-		}},
-		// Invalid password
-		{"PUT", "/" + name, gofight.H{"f": newData, "ep": "China. Top public"}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
-			assert.Equal(t, http.StatusUnauthorized, r.Code)
-		}},
-		// Success change
-		{"PUT", "/" + name, gofight.H{"f": newData, "ep": password}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			name = r.Body.String()
+		})
+
+	env.r.GET("/"+name+"?ap="+password).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
 			assert.Equal(t, http.StatusOK, r.Code)
-		}},
-		// Check
-		{"GET", "/" + name, gofight.H{}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, "Dockerfile\ndocker-compose.yml\nbuild #1.log\n", r.Body.String())
+		})
+	env.r.GET("/"+name+".html?ap="+password).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
 			assert.Equal(t, http.StatusOK, r.Code)
-			assert.Equal(t, newData, r.Body.String())
-		}},
-		// Large data
-		{"PUT", "/" + name, gofight.H{"f": strings.Repeat("0", 10<<20), "ep": password}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
-			assert.Equal(t, http.StatusRequestEntityTooLarge, r.Code)
-		}},
-		// Without Data
-		{"PUT", "/" + name, gofight.H{"ep": password}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
-			assert.Equal(t, http.StatusBadRequest, r.Code)
-		}},
-		// Invalid name
-		{"PUT", "/nnnnnnnn775", gofight.H{"f": newData, "ep": password}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
-			assert.Equal(t, http.StatusNotFound, r.Code)
-			time.Sleep(1 * time.Second)
-		}},
-		// Edit expired file
-		{"PUT", "/" + name, gofight.H{"f": data, "ep": password}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
-			assert.Equal(t, http.StatusGone, r.Code)
-		}},
+			assert.Contains(t, r.Body.String(), `<a href="/`+name+`/build%20%231.log">build #1.log</a>`)
+		})
+
+	for _, f := range files {
+		env.r.GET("/"+name+"/"+url.PathEscape(f.filename)+"?ap="+password).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+				assert.Equal(t, f.content, r.Body.String())
+			})
 	}
 
+	testCases := []struct {
+		path string
+		code int
+	}{
+		{"/" + name + "/Dockerfile", http.StatusUnauthorized},
+		{"/" + name + "/Makefile?ap=" + password, http.StatusNotFound},
+		{"/404/Dockerfile", http.StatusNotFound},
+	}
 	for _, cs := range testCases {
-		var rq *gofight.RequestConfig
-		switch cs.method {
-		case "PUT":
-			rq = env.r.PUT(cs.path)
-		case "GET":
-			rq = env.r.GET(cs.path)
-		}
-		rq.SetForm(cs.params).
-			Run(env.router, cs.asserts)
+		env.r.GET(cs.path).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, cs.code, r.Code)
+			})
+	}
+
+	for _, filename := range []string{"a.txt", "events", "shares"} {
+		body, headers = multipartForm(gofight.H{}, testFile{"f", "a.txt", "a"}, testFile{"f", filename, "b"})
+		gofight.New().POST("/").
+			SetBody(body).
+			SetHeader(headers).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusBadRequest, r.Code)
+			})
 	}
 }
 
-func TestEditFileWithoutEP(t *testing.T) {
-	data := "42"
-	newData := "43"
-	password := "USA. Top secret"
+func TestArchive(t *testing.T) {
+	files := []testFile{
+		{"f", "Dockerfile", "FROM golang:1.15\n"},
+		{"f", "build.log", "ok\n"},
+	}
 
 	var name string
+	body, headers := multipartForm(gofight.H{}, files...)
+	gofight.New().POST("/").
+		SetBody(body).
+		SetHeader(headers).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			name = r.Body.String()
+		})
+
+	env.r.GET("/"+name+".tar.gz").
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, "attachment; filename="+name+".tar.gz", r.HeaderMap.Get("Content-Disposition"))
+			gr, err := gzip.NewReader(r.Body)
+			assert.NoError(t, err)
+			tr := tar.NewReader(gr)
+			for _, f := range files {
+				header, err := tr.Next()
+				assert.NoError(t, err)
+				assert.Equal(t, f.filename, header.Name)
+				data, _ := ioutil.ReadAll(tr)
+				assert.Equal(t, f.content, string(data))
+			}
+			_, err = tr.Next()
+			assert.Equal(t, io.EOF, err)
+		})
+
+	env.r.GET("/"+name+".zip").
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			zr, err := zip.NewReader(bytes.NewReader(r.Body.Bytes()), int64(r.Body.Len()))
+			assert.NoError(t, err)
+			assert.Len(t, zr.File, len(files))
+			for i, f := range zr.File {
+				assert.Equal(t, files[i].filename, f.Name)
+				rc, _ := f.Open()
+				data, _ := ioutil.ReadAll(rc)
+				assert.Equal(t, files[i].content, string(data))
+			}
+		})
+
+	// Single file paste is archived as file named by paste
+	env.r.POST("/").
+		SetForm(gofight.H{"f": "single"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			name = r.Body.String()
+		})
+	env.r.GET("/"+name+".zip").
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			zr, err := zip.NewReader(bytes.NewReader(r.Body.Bytes()), int64(r.Body.Len()))
+			assert.NoError(t, err)
+			assert.Len(t, zr.File, 1)
+			assert.Equal(t, name, zr.File[0].Name)
+		})
+}
+
+func TestSuggestName(t *testing.T) {
+	testCases := map[string]string{
+		"build.log":      "build",
+		"archive.tar.gz": "archive",
+		".bashrc":        "bashrc",
+		"my file (1).go": "my-file--1",
+		"api.go":         "",
+		"-":              "",
+		"файл.txt":       "",
+	}
+	for filename, name := range testCases {
+		assert.Equal(t, name, SuggestName(filename), filename)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	password := "etag"
+	var name, etag, modified string
 	env.r.POST("/").
 		SetForm(gofight.H{
-			"f": data,
+			"f":  "cached",
+			"ep": password,
 		}).
 		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
-			assert.Equal(t, http.StatusOK, r.Code)
 			name = r.Body.String()
 		})
+	env.r.GET("/"+name).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			etag = r.HeaderMap.Get("ETag")
+			modified = r.HeaderMap.Get("Last-Modified")
+			assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+			assert.NotEmpty(t, modified)
+			assert.Equal(t, "public, no-cache", r.HeaderMap.Get("Cache-Control"))
+		})
+
+	testCases := []struct {
+		headers gofight.H
+		code    int
+	}{
+		{gofight.H{"If-None-Match": etag}, http.StatusNotModified},
+		{gofight.H{"If-None-Match": `"other", ` + etag}, http.StatusNotModified},
+		{gofight.H{"If-None-Match": `"other"`}, http.StatusOK},
+		{gofight.H{"If-Modified-Since": modified}, http.StatusNotModified},
+		{gofight.H{"If-Modified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"}, http.StatusOK},
+	}
+	for _, cs := range testCases {
+		gofight.New().GET("/"+name).
+			SetHeader(cs.headers).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, cs.code, r.Code, cs.headers)
+				if cs.code == http.StatusNotModified {
+					assert.Empty(t, r.Body.String())
+				}
+			})
+	}
 
+	// ETag changes after edit
 	env.r.PUT("/"+name).
+		SetForm(gofight.H{"f": "changed", "ep": password}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	gofight.New().GET("/"+name).
+		SetHeader(gofight.H{"If-None-Match": etag}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.NotEqual(t, etag, r.HeaderMap.Get("ETag"))
+		})
+}
+
+func TestEditIfMatch(t *testing.T) {
+	password := "optimistic"
+	var name, etag string
+	env.r.POST("/").
 		SetForm(gofight.H{
-			"f":  newData,
+			"f":  "v1",
 			"ep": password,
 		}).
 		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
-			assert.Equal(t, http.StatusUnauthorized, r.Code)
+			name = r.Body.String()
+		})
+	env.r.GET("/"+name).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			etag = r.HeaderMap.Get("ETag")
+		})
+
+	// First editor wins, second one has stale ETag
+	var newETag string
+	gofight.New().PUT("/"+name).
+		SetForm(gofight.H{"f": "v2", "ep": password}).
+		SetHeader(gofight.H{"If-Match": etag}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			newETag = r.HeaderMap.Get("ETag")
+			assert.NotEqual(t, etag, newETag)
+		})
+
+	testCases := []struct {
+		ifMatch string
+		code    int
+	}{
+		{etag, http.StatusPreconditionFailed},
+		{"W/" + newETag, http.StatusPreconditionFailed},
+		{`"other", ` + newETag, http.StatusOK},
+		{"*", http.StatusOK},
+	}
+	for _, cs := range testCases {
+		gofight.New().PUT("/"+name).
+			SetForm(gofight.H{"f": "v3", "ep": password}).
+			SetHeader(gofight.H{"If-Match": cs.ifMatch}).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, cs.code, r.Code, cs.ifMatch)
+			})
+	}
+
+	// Password is checked before ETag
+	gofight.New().PUT("/"+name).
+		SetForm(gofight.H{"f": "v4"}).
+		SetHeader(gofight.H{"If-Match": etag}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		})
+	env.r.GET("/"+name).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, "v3", r.Body.String())
+		})
+}
+
+func TestCacheControl(t *testing.T) {
+	testCases := []struct {
+		form  gofight.H
+		cache string
+	}{
+		{gofight.H{"f": "forever"}, "public, max-age=31536000, immutable"},
+		{gofight.H{"f": "expires", "e": "3600"}, "public, max-age=3599"},
+		{gofight.H{"f": "protected", "ap": "pass", "e": "3600"}, "private, no-cache"},
+	}
+	var name string
+	for _, cs := range testCases {
+		env.r.POST("/").
+			SetForm(cs.form).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				name = r.Body.String()
+			})
+		env.r.GET("/"+name+"?ap=pass").
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, cs.cache, r.HeaderMap.Get("Cache-Control"))
+				assert.Equal(t, "Accept", r.HeaderMap.Get("Vary"))
+			})
+	}
+
+	// Colored output depends on User-Agent too
+	env.r.GET("/"+name+"?color").
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, "Accept, User-Agent", r.HeaderMap.Get("Vary"))
+		})
+}
+
+func TestRange(t *testing.T) {
+	data := "0123456789"
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{"f": data}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			name = r.Body.String()
+		})
+
+	gofight.New().GET("/"+name).
+		SetHeader(gofight.H{"Range": "bytes=-3"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPartialContent, r.Code)
+			assert.Equal(t, "bytes", r.HeaderMap.Get("Accept-Ranges"))
+			assert.Equal(t, "bytes 7-9/10", r.HeaderMap.Get("Content-Range"))
+			assert.Equal(t, "789", r.Body.String())
+		})
+
+	gofight.New().GET("/"+name).
+		SetHeader(gofight.H{"Range": "bytes=0-1,5-6"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPartialContent, r.Code)
+			mediatype, params, err := mime.ParseMediaType(r.HeaderMap.Get("Content-Type"))
+			assert.NoError(t, err)
+			assert.Equal(t, "multipart/byteranges", mediatype)
+			mr := multipart.NewReader(r.Body, params["boundary"])
+			for _, expected := range []string{"01", "56"} {
+				part, err := mr.NextPart()
+				assert.NoError(t, err)
+				got, _ := ioutil.ReadAll(part)
+				assert.Equal(t, expected, string(got))
+			}
+		})
+
+	gofight.New().GET("/"+name).
+		SetHeader(gofight.H{"Range": "bytes=20-30"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, r.Code)
+		})
+}
+
+func TestHeadTail(t *testing.T) {
+	data := "1\n2\n3\n4\n5\n"
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{"f": data}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			name = r.Body.String()
+		})
+
+	testCases := []struct {
+		query string
+		code  int
+		body  string
+	}{
+		{"?head=2", http.StatusOK, "1\n2\n"},
+		{"?tail=2", http.StatusOK, "4\n5\n"},
+		{"?tail=10", http.StatusOK, data},
+		{"?head=0", http.StatusOK, ""},
+		{"?head=-1", http.StatusBadRequest, ""},
+		{"?head=1&tail=1", http.StatusBadRequest, ""},
+	}
+	for _, cs := range testCases {
+		env.r.GET("/"+name+cs.query).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, cs.code, r.Code, cs.query)
+				if cs.code == http.StatusOK {
+					assert.Equal(t, cs.body, r.Body.String(), cs.query)
+				}
+			})
+	}
+}
+
+func TestLines(t *testing.T) {
+	data := "1\n2\n3\n4\n5\n"
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{"f": data}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			name = r.Body.String()
+		})
+
+	testCases := []struct {
+		query string
+		code  int
+		body  string
+	}{
+		{"?lines=2-3", http.StatusOK, "2\n3\n"},
+		{"?lines=L2-L3", http.StatusOK, "2\n3\n"},
+		{"?lines=4", http.StatusOK, "4\n"},
+		{"?lines=4-100", http.StatusOK, "4\n5\n"},
+		{"?lines=3-2", http.StatusBadRequest, ""},
+		{"?lines=0-2", http.StatusBadRequest, ""},
+		{"?lines=a-b", http.StatusBadRequest, ""},
+		{"?lines=2-3&head=1", http.StatusBadRequest, ""},
+	}
+	for _, cs := range testCases {
+		env.r.GET("/"+name+cs.query).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, cs.code, r.Code, cs.query)
+				if cs.code == http.StatusOK {
+					assert.Equal(t, cs.body, r.Body.String(), cs.query)
+				}
+			})
+	}
+
+	// Colored output keeps line numbers of the original file
+	env.r.GET("/"+name+"?lines=2-3&color=force&ln").
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.True(t, strings.HasPrefix(r.Body.String(), "\x1b[38;5;244m2\x1b[0m  "))
+		})
+
+	// HTML view shows whole file with highlighted lines
+	env.r.GET("/"+name+".html?lines=2-3").
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, 2, strings.Count(r.Body.String(), `class="line hl"`))
+			assert.Contains(t, r.Body.String(), `id="L5"`)
+			assert.Contains(t, r.Body.String(), "<script>")
+		})
+}
+
+func TestLineRange(t *testing.T) {
+	testCases := []struct {
+		data     string
+		from, to int
+		expected string
+	}{
+		{"a\nb\nc\n", 2, 3, "b\nc\n"},
+		{"a\nb\nc", 2, 3, "b\nc"},
+		{"a\nb\nc", 3, 10, "c"},
+		{"a\nb\nc", 0, 1, "a\n"},
+		{"a\nb\nc", 4, 5, ""},
+		{"a\nb\nc\n", 4, 5, ""},
+		{"", 1, 1, ""},
+	}
+	for _, cs := range testCases {
+		assert.Equal(t, cs.expected, string(LineRange([]byte(cs.data), cs.from, cs.to)), cs)
+	}
+	assert.Equal(t, 3, CountLines([]byte("a\nb\nc")))
+	assert.Equal(t, 3, CountLines([]byte("a\nb\nc\n")))
+	assert.Equal(t, 0, CountLines(nil))
+}
+
+func TestEditFile(t *testing.T) {
+	data := "42"
+	newData := "43"
+	password := "USA. Top secret"
+	e := "1"
+
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{
+			"f":  data,
+			"e":  e,
+			"ep": password,
+		}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			name = r.Body.String()
+		})
+
+	testCases := []struct {
+		method  string
+		path    string
+		params  gofight.H
+		asserts func(gofight.HTTPResponse, gofight.HTTPRequest)
+	}{
+		{"GET", "/" + name, gofight.H{}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, data, r.Body.String())
+		}},
+		// Without password
+		{"PUT", "/" + name, gofight.H{"f": newData}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		}},
+		// Invalid password
+		{"PUT", "/" + name, gofight.H{"f": newData, "ep": "China. Top public"}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		}},
+		// Success change
+		{"PUT", "/" + name, gofight.H{"f": newData, "ep": password}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		}},
+		// Check
+		{"GET", "/" + name, gofight.H{}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, newData, r.Body.String())
+		}},
+		// Large data
+		{"PUT", "/" + name, gofight.H{"f": strings.Repeat("0", 10<<20), "ep": password}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusRequestEntityTooLarge, r.Code)
+		}},
+		// Without Data
+		{"PUT", "/" + name, gofight.H{"ep": password}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+		}},
+		// Invalid name
+		{"PUT", "/nnnnnnnn775", gofight.H{"f": newData, "ep": password}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusNotFound, r.Code)
+			time.Sleep(1 * time.Second)
+		}},
+		// Edit expired file
+		{"PUT", "/" + name, gofight.H{"f": data, "ep": password}, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusGone, r.Code)
+		}},
+	}
+
+	for _, cs := range testCases {
+		var rq *gofight.RequestConfig
+		switch cs.method {
+		case "PUT":
+			rq = env.r.PUT(cs.path)
+		case "GET":
+			rq = env.r.GET(cs.path)
+		}
+		rq.SetForm(cs.params).
+			Run(env.router, cs.asserts)
+	}
+}
+
+func TestEditFileWithoutEP(t *testing.T) {
+	data := "42"
+	newData := "43"
+	password := "USA. Top secret"
+
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{
+			"f": data,
+		}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			name = r.Body.String()
+		})
+
+	env.r.PUT("/"+name).
+		SetForm(gofight.H{
+			"f":  newData,
+			"ep": password,
+		}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		})
+}
+
+func TestAppendFile(t *testing.T) {
+	password := "ci"
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{
+			"f":   "step 1\n",
+			"ep":  password,
+			"max": "21",
+		}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			name = r.Body.String()
+		})
+
+	testCases := []struct {
+		path string
+		form gofight.H
+		code int
+	}{
+		{"/" + name + "/append", gofight.H{"f": "step 2\n", "ep": password}, http.StatusOK},
+		{"/" + name + "/append", gofight.H{"f": "step 3\n", "ep": password}, http.StatusOK},
+		// Without password
+		{"/" + name + "/append", gofight.H{"f": "step 4\n"}, http.StatusUnauthorized},
+		// Over max size
+		{"/" + name + "/append", gofight.H{"f": "step 4\n", "ep": password}, http.StatusRequestEntityTooLarge},
+		// Without data
+		{"/" + name + "/append", gofight.H{"ep": password}, http.StatusBadRequest},
+		{"/404/append", gofight.H{"f": "step 4\n", "ep": password}, http.StatusNotFound},
+	}
+	for _, cs := range testCases {
+		env.r.POST(cs.path).
+			SetForm(cs.form).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, cs.code, r.Code, cs.form)
+			})
+	}
+
+	env.r.GET("/"+name).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, "step 1\nstep 2\nstep 3\n", r.Body.String())
+		})
+
+	// Edits can't exceed max size either
+	env.r.PUT("/"+name).
+		SetForm(gofight.H{"f": "much longer than max size\n", "ep": password}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusRequestEntityTooLarge, r.Code)
+		})
+	env.r.PUT("/"+name).
+		SetForm(gofight.H{"f": "short\n", "ep": password}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+
+	env.r.POST("/").
+		SetForm(gofight.H{"f": "too long", "max": "3"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusRequestEntityTooLarge, r.Code)
+		})
+}
+
+func TestAppendConcurrent(t *testing.T) {
+	const n = 20
+	password := "parallel"
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{"f": "start\n", "ep": password}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			name = r.Body.String()
+		})
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			form := url.Values{"f": {"line\n"}, "ep": {password}}
+			req := httptest.NewRequest("POST", "/"+name+"/append", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			env.router.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+
+	env.r.GET("/"+name).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, "start\n"+strings.Repeat("line\n", n), r.Body.String())
+		})
+}
+
+// openStream start GET request to test server and return scanner of
+// response lines and function which closes connection
+func openStream(t *testing.T, url string) (*bufio.Scanner, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return bufio.NewScanner(resp.Body), func() {
+		cancel()
+		resp.Body.Close()
+	}
+}
+
+func assertLines(t *testing.T, lines *bufio.Scanner, expected ...string) {
+	for _, line := range expected {
+		assert.True(t, lines.Scan())
+		assert.Equal(t, line, lines.Text())
+	}
+}
+
+func TestFollow(t *testing.T) {
+	password := "follow"
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{"f": "start\n", "ep": password}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			name = r.Body.String()
+		})
+
+	server := httptest.NewServer(env.router)
+	defer server.Close()
+
+	lines, closeStream := openStream(t, server.URL+"/"+name+"?follow=1")
+	assertLines(t, lines, "start")
+	env.r.POST("/"+name+"/append").
+		SetForm(gofight.H{"f": "more\n", "ep": password}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {})
+	assertLines(t, lines, "more")
+	assert.Equal(t, 1, Events.Subscribers(name))
+
+	// Subscription is removed after client disconnects
+	closeStream()
+	for i := 0; i < 100 && Events.Subscribers(name) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, Events.Subscribers(name))
+
+	// Concurrent appends are published in the order they are saved
+	events := Events.Subscribe(name)
+	defer Events.Unsubscribe(name, events)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gofight.New().POST("/"+name+"/append").
+				SetForm(gofight.H{"f": "line\n", "ep": password}).
+				Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {})
+		}()
+	}
+	wg.Wait()
+	size := len("start\nmore\n")
+	for i := 0; i < 20; i++ {
+		e := <-events
+		assert.Equal(t, size, e.Offset)
+		size = e.Offset + len(e.Data)
+	}
+}
+
+func TestFileEvents(t *testing.T) {
+	password := "events"
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{"f": "start\n", "ep": password}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			name = r.Body.String()
+		})
+
+	server := httptest.NewServer(env.router)
+	defer server.Close()
+
+	lines, closeStream := openStream(t, server.URL+"/"+name+"/events")
+	defer closeStream()
+	assertLines(t, lines, "event: edit", "data: start", "data: ", "")
+
+	env.r.POST("/"+name+"/append").
+		SetForm(gofight.H{"f": "more\n", "ep": password}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {})
+	assertLines(t, lines, "event: append", "data: more", "data: ", "")
+
+	env.r.PUT("/"+name).
+		SetForm(gofight.H{"f": "new", "ep": password}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {})
+	assertLines(t, lines, "event: edit", "data: new", "")
+
+	env.r.DELETE("/"+name).
+		SetQuery(gofight.H{"ep": password}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {})
+	assertLines(t, lines, "event: delete", "data: ", "")
+	assert.False(t, lines.Scan())
+}
+
+func TestTransform(t *testing.T) {
+	doc := []rune("hello")
+	cases := []struct{ a, b Operation }{
+		{Operation{}.Retain(5).Insert(" world"), Operation{}.Insert("Oh ").Retain(5)},
+		{Operation{}.Retain(2).Insert("X").Retain(3), Operation{}.Retain(2).Insert("Y").Retain(3)},
+		{Operation{}.Retain(1).Delete(3).Retain(1), Operation{}.Retain(2).Delete(2).Insert("p!").Retain(1)},
+		{Operation{}.Delete(5).Insert("bye"), Operation{}.Retain(3).Insert("ium").Retain(2)},
+	}
+	for _, c := range cases {
+		aPrime, bPrime, err := Transform(c.a, c.b)
+		assert.NoError(t, err)
+		docA, err := c.a.Apply(doc)
+		assert.NoError(t, err)
+		docA, err = bPrime.Apply(docA)
+		assert.NoError(t, err)
+		docB, err := c.b.Apply(doc)
+		assert.NoError(t, err)
+		docB, err = aPrime.Apply(docB)
+		assert.NoError(t, err)
+		assert.Equal(t, string(docA), string(docB))
+	}
+
+	// Text of the first operation goes first
+	aPrime, _, _ := Transform(cases[1].a, cases[1].b)
+	docB, _ := cases[1].b.Apply(doc)
+	docB, _ = aPrime.Apply(docB)
+	assert.Equal(t, "heXYllo", string(docB))
+
+	var op Operation
+	assert.NoError(t, json.Unmarshal([]byte(`[2, "ab", -1, "c", 1]`), &op))
+	assert.Equal(t, Operation{}.Retain(2).Insert("abc").Delete(1).Retain(1), op)
+	encoded, _ := json.Marshal(op)
+	assert.Equal(t, `[2,"abc",-1,1]`, string(encoded))
+	assert.Error(t, json.Unmarshal([]byte(`[0]`), &op))
+	assert.Error(t, json.Unmarshal([]byte(`[4611686018427387904,-4611686018427387904,4611686018427387904,-4611686018427387904,5]`), &op))
+	_, err := Operation{Component{Retain: 1 << 62}, Component{Delete: -(1 << 62)}, Component{Retain: 5}}.Apply(doc)
+	assert.Equal(t, ErrInvalidOperation, err)
+	_, _, err = Transform(Operation{}.Retain(1), Operation{}.Retain(2))
+	assert.Equal(t, ErrInvalidOperation, err)
+}
+
+// collabEditor is client of collaborative editing which keeps one
+// operation waiting for acknowledgement
+type collabEditor struct {
+	conn    *websocket.Conn
+	doc     []rune
+	rev     int
+	pending Operation
+}
+
+func dialCollab(t *testing.T, url string) *collabEditor {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var msg collabMessage
+	assert.NoError(t, conn.ReadJSON(&msg))
+	assert.Equal(t, "init", msg.Type)
+	return &collabEditor{conn: conn, doc: []rune(*msg.Doc), rev: msg.Rev}
+}
+
+func (e *collabEditor) send(t *testing.T, op Operation) {
+	doc, err := op.Apply(e.doc)
+	assert.NoError(t, err)
+	e.doc, e.pending = doc, op
+	assert.NoError(t, e.conn.WriteJSON(collabMessage{Type: "op", Rev: e.rev, Op: op}))
+}
+
+// receive handle messages until document reaches revision rev
+func (e *collabEditor) receive(t *testing.T, rev int) {
+	for e.rev < rev || e.pending != nil {
+		var msg collabMessage
+		if !assert.NoError(t, e.conn.ReadJSON(&msg)) {
+			return
+		}
+		switch msg.Type {
+		case "ack":
+			e.pending = nil
+		case "op":
+			op := msg.Op
+			if e.pending != nil {
+				e.pending, op, _ = Transform(e.pending, op)
+			}
+			doc, err := op.Apply(e.doc)
+			assert.NoError(t, err)
+			e.doc = doc
+		default:
+			t.Fatal(msg.Error)
+		}
+		e.rev = msg.Rev
+	}
+}
+
+func TestCollab(t *testing.T) {
+	password := "collab"
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{"f": "hello", "ep": password}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			name = r.Body.String()
+		})
+
+	server := httptest.NewServer(env.router)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/" + name + "/collab"
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?ep=wrong", nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	first := dialCollab(t, url+"?ep="+password)
+	second := dialCollab(t, url+"?ep="+password)
+
+	// Concurrent edits made on the same revision
+	first.send(t, Operation{}.Retain(5).Insert(" world"))
+	second.send(t, Operation{}.Insert("Oh ").Retain(5))
+	first.receive(t, 2)
+	second.receive(t, 2)
+	assert.Equal(t, "Oh hello world", string(first.doc))
+	assert.Equal(t, "Oh hello world", string(second.doc))
+
+	// Operation on unknown document is rejected
+	assert.NoError(t, first.conn.WriteJSON(collabMessage{Type: "op", Rev: 2, Op: Operation{}.Retain(1)}))
+	var msg collabMessage
+	assert.NoError(t, first.conn.ReadJSON(&msg))
+	assert.Equal(t, "error", msg.Type)
+
+	// Appended data is sent to editors
+	env.r.POST("/"+name+"/append").
+		SetForm(gofight.H{"f": "!", "ep": password}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {})
+	first.receive(t, 3)
+	assert.Equal(t, "Oh hello world!", string(first.doc))
+
+	// Document is saved when the last editor leaves
+	first.conn.Close()
+	second.conn.Close()
+	data := ""
+	for i := 0; i < 100 && data != "Oh hello world!"; i++ {
+		time.Sleep(10 * time.Millisecond)
+		file, _ := OpenWpasteByName([]byte(name))
+		data = string(file.Data)
+	}
+	assert.Equal(t, "Oh hello world!", data)
+}
+
+func TestAccounts(t *testing.T) {
+	var token string
+	env.r.POST("/api/v1/users").
+		SetForm(gofight.H{"name": "alice"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			token = r.Body.String()
+		})
+	env.r.POST("/api/v1/users").
+		SetForm(gofight.H{"name": "alice"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusConflict, r.Code)
+		})
+	var other string
+	env.r.POST("/api/v1/users").
+		SetForm(gofight.H{"name": "bob"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			other = r.Body.String()
+		})
+
+	gofight.New().POST("/").
+		SetHeader(gofight.H{"Authorization": "Bearer wrong"}).
+		SetForm(gofight.H{"f": "data"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		})
+
+	var name string
+	gofight.New().POST("/").
+		SetHeader(gofight.H{"Authorization": "Bearer " + token}).
+		SetForm(gofight.H{"f": "data"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			name = r.Body.String()
+		})
+	file, _ := OpenWpasteByName([]byte(name))
+	assert.Equal(t, "alice", file.Owner)
+	assert.Equal(t, "public, no-cache", file.CacheControl())
+
+	// Only owner can edit file without password
+	gofight.New().PUT("/"+name).
+		SetHeader(gofight.H{"Authorization": "Bearer " + other}).
+		SetForm(gofight.H{"f": "bob's"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		})
+	gofight.New().PUT("/"+name).
+		SetHeader(gofight.H{"Authorization": "Bearer " + token}).
+		SetForm(gofight.H{"f": "alice's"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	gofight.New().POST("/"+name+"/append").
+		SetHeader(gofight.H{"Authorization": "Bearer " + token}).
+		SetForm(gofight.H{"f": "!"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	env.r.GET("/"+name).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, "alice's!", r.Body.String())
+		})
+
+	// Revoked token can't be used
+	var second string
+	gofight.New().POST("/api/v1/tokens").
+		SetHeader(gofight.H{"Authorization": "Bearer " + token}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			second = r.Body.String()
+		})
+	gofight.New().DELETE("/api/v1/tokens").
+		SetHeader(gofight.H{"Authorization": "Bearer " + token}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	gofight.New().DELETE("/"+name).
+		SetHeader(gofight.H{"Authorization": "Bearer " + token}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		})
+	gofight.New().DELETE("/"+name).
+		SetHeader(gofight.H{"Authorization": "Bearer " + second}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	file, _ = OpenWpasteByName([]byte(name))
+	assert.Nil(t, file)
+}
+
+func TestListPastes(t *testing.T) {
+	var token string
+	env.r.POST("/api/v1/users").
+		SetForm(gofight.H{"name": "carol"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			token = r.Body.String()
+		})
+	auth := gofight.H{"Authorization": "Bearer " + token}
+	for _, name := range []string{"carol-b", "carol-a", "notes-carol"} {
+		gofight.New().POST("/").
+			SetHeader(auth).
+			SetForm(gofight.H{"f": "data", "name": name}).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+			})
+	}
+	UpdateWpaste([]byte("notes-carol"), func(file *WpasteFile) error {
+		file.ExpiresAfter = time.Now().UTC().UnixNano() - 1
+		return nil
+	})
+
+	type list struct {
+		Pastes []PasteInfo
+		Next   string
+	}
+	get := func(query gofight.H) (l list) {
+		gofight.New().GET("/api/v1/pastes").
+			SetHeader(auth).
+			SetQuery(query).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+				assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &l))
+			})
+		return
+	}
+	names := func(l list) (names []string) {
+		for _, p := range l.Pastes {
+			names = append(names, p.Name)
+		}
+		return
+	}
+
+	page := get(gofight.H{"limit": "2"})
+	assert.Equal(t, []string{"carol-a", "carol-b"}, names(page))
+	assert.Equal(t, "carol-b", page.Next)
+	assert.Equal(t, 4, page.Pastes[0].Size)
+	page = get(gofight.H{"limit": "2", "cursor": page.Next})
+	assert.Equal(t, []string{"notes-carol"}, names(page))
+	assert.True(t, page.Pastes[0].Expired)
+	assert.Empty(t, page.Next)
+
+	assert.Equal(t, []string{"carol-a", "carol-b"}, names(get(gofight.H{"prefix": "carol"})))
+	assert.Equal(t, []string{"carol-b"}, names(get(gofight.H{"prefix": "carol", "cursor": "carol-a"})))
+	assert.Equal(t, []string{"notes-carol"}, names(get(gofight.H{"status": "expired"})))
+	assert.Equal(t, []string{"carol-a", "carol-b"}, names(get(gofight.H{"status": "active"})))
+	assert.Empty(t, names(get(gofight.H{"since": time.Now().Add(time.Hour).Format(time.RFC3339)})))
+	assert.Len(t, names(get(gofight.H{"until": time.Now().Add(time.Hour).Format(time.RFC3339)})), 3)
+
+	// Deleted files are removed from list
+	gofight.New().DELETE("/carol-a").
+		SetHeader(auth).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	assert.Equal(t, []string{"carol-b"}, names(get(gofight.H{"prefix": "carol"})))
+
+	env.r.GET("/api/v1/pastes").
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		})
+	gofight.New().GET("/api/v1/pastes").
+		SetHeader(auth).
+		SetQuery(gofight.H{"status": "unknown"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+		})
+}
+
+func TestShares(t *testing.T) {
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{"f": "shared", "ap": "read", "ep": "edit"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			name = r.Body.String()
+		})
+	issue := func(form gofight.H) (token string) {
+		env.r.POST("/"+name+"/shares").
+			SetForm(form).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+				token = r.Body.String()
+			})
+		return
+	}
+	read := func(token string, code int) {
+		env.r.GET("/"+name).
+			SetQuery(gofight.H{"share": token}).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, code, r.Code)
+			})
+	}
+
+	env.r.POST("/"+name+"/shares").
+		SetForm(gofight.H{"ep": "wrong"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		})
+	env.r.POST("/"+name+"/shares").
+		SetForm(gofight.H{"ep": "edit", "scope": "admin"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+		})
+
+	// Share can be used limited number of times
+	token := issue(gofight.H{"ep": "edit", "uses": "2"})
+	read(token, http.StatusOK)
+	read(token, http.StatusOK)
+	read(token, http.StatusUnauthorized)
+
+	// Share gives only its scopes
+	reader := issue(gofight.H{"ep": "edit"})
+	editor := issue(gofight.H{"ep": "edit", "scope": "read,edit"})
+	env.r.PUT("/"+name).
+		SetForm(gofight.H{"f": "changed", "share": reader}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		})
+	env.r.PUT("/"+name).
+		SetForm(gofight.H{"f": "changed", "share": editor}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	env.r.GET("/"+name).
+		SetQuery(gofight.H{"share": editor}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, "changed", r.Body.String())
+		})
+	env.r.DELETE("/"+name).
+		SetQuery(gofight.H{"share": editor}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		})
+
+	// Use is counted only when share gives access and file is saved
+	once := issue(gofight.H{"ep": "edit", "scope": "edit", "uses": "1"})
+	edit := func(form gofight.H, header gofight.H, code int) {
+		gofight.New().PUT("/"+name).
+			SetForm(form).
+			SetHeader(header).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, code, r.Code)
+			})
+	}
+	edit(gofight.H{"f": "changed", "share": once}, gofight.H{"If-Match": `"stale"`}, http.StatusPreconditionFailed)
+	edit(gofight.H{"f": "changed", "share": once, "ep": "edit"}, gofight.H{}, http.StatusOK)
+	edit(gofight.H{"f": "changed", "share": once}, gofight.H{}, http.StatusOK)
+	edit(gofight.H{"f": "changed", "share": once}, gofight.H{}, http.StatusUnauthorized)
+
+	// Expired share doesn't work
+	expired, _ := NewShare([]byte(name), &Share{Scopes: []string{ScopeRead}, ExpiresAfter: 1})
+	read(expired, http.StatusUnauthorized)
+
+	// Revoked share doesn't work
+	var shares []ShareInfo
+	env.r.GET("/"+name+"/shares").
+		SetQuery(gofight.H{"ep": "edit"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &shares))
+		})
+	assert.Len(t, shares, 3)
+	for _, share := range shares {
+		env.r.DELETE("/"+name+"/shares/"+share.ID).
+			SetQuery(gofight.H{"ep": "edit"}).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, r.Code)
+			})
+	}
+	read(reader, http.StatusUnauthorized)
+	env.r.DELETE("/"+name+"/shares/"+shares[0].ID).
+		SetQuery(gofight.H{"ep": "edit"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusNotFound, r.Code)
+		})
+
+	deleter := issue(gofight.H{"ep": "edit", "scope": "delete"})
+	env.r.DELETE("/"+name).
+		SetQuery(gofight.H{"share": deleter}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	shares, _ = FileShares([]byte(name))
+	assert.Empty(t, shares)
+}
+
+func TestSignedURL(t *testing.T) {
+	defer func(keys [][]byte) { signingKeys = keys }(signingKeys)
+
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{"f": "signed", "ap": "read", "ep": "edit"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			name = r.Body.String()
+		})
+	get := func(path string, code int) {
+		env.r.GET(path).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, code, r.Code)
+			})
+	}
+
+	env.r.POST("/"+name+"/sign").
+		SetForm(gofight.H{"ap": "read"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		})
+	var signed string
+	env.r.POST("/"+name+"/sign").
+		SetForm(gofight.H{"ep": "edit", "e": "60"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			signed = r.Body.String()
+		})
+	assert.True(t, strings.HasPrefix(signed, "/"+name+"?exp="))
+	get(signed, http.StatusOK)
+	get(strings.Replace(signed, "exp=", "exp=1", 1), http.StatusUnauthorized)
+	get(signed[:len(signed)-2], http.StatusUnauthorized)
+	file, _ := OpenWpasteByName([]byte(name))
+	get(SignURL(file, time.Now().Unix()-1), http.StatusUnauthorized)
+
+	// Signature is checked with all keys, the first one signs
+	SetSigningKeys([]string{"old"})
+	old := SignURL(file, time.Now().Unix()+60)
+	SetSigningKeys([]string{"new", "old"})
+	get(old, http.StatusOK)
+	assert.NotEqual(t, old, SignURL(file, time.Now().Unix()+60))
+	SetSigningKeys([]string{"new"})
+	get(old, http.StatusUnauthorized)
+
+	// Link doesn't work for new file with the same name
+	gofight.New().POST("/").
+		SetForm(gofight.H{"f": "first", "ap": "read", "ep": "edit", "name": "signed-reuse"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	file, _ = OpenWpasteByName([]byte("signed-reuse"))
+	signed = SignURL(file, time.Now().Unix()+60)
+	get(signed, http.StatusOK)
+	gofight.New().DELETE("/signed-reuse").
+		SetQuery(gofight.H{"ep": "edit"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	gofight.New().POST("/").
+		SetForm(gofight.H{"f": "second", "ap": "bob", "name": "signed-reuse"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	get(signed, http.StatusUnauthorized)
+}
+
+func TestCredentialHeaders(t *testing.T) {
+	var name string
+	gofight.New().POST("/").
+		SetHeader(gofight.H{AccessPasswordHeader: "read", EditPasswordHeader: "edit"}).
+		SetForm(gofight.H{"f": "headers"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			name = r.Body.String()
+		})
+	read := func(headers gofight.H, code int) {
+		gofight.New().GET("/"+name).
+			SetHeader(headers).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, code, r.Code)
+			})
+	}
+	basic := func(password string) string {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth("", password)
+		return req.Header.Get("Authorization")
+	}
+
+	read(gofight.H{}, http.StatusUnauthorized)
+	read(gofight.H{AccessPasswordHeader: "read"}, http.StatusOK)
+	read(gofight.H{"Authorization": basic("read")}, http.StatusOK)
+	read(gofight.H{"Authorization": basic("edit")}, http.StatusUnauthorized)
+
+	// Passwords in URL are rejected in strict mode
+	StrictCredentials = true
+	defer func() { StrictCredentials = false }()
+	env.r.GET("/"+name).
+		SetQuery(gofight.H{"ap": "read"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+		})
+	read(gofight.H{AccessPasswordHeader: "read"}, http.StatusOK)
+	env.r.PUT("/"+name).
+		SetForm(gofight.H{"f": "changed", "ep": "edit"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	gofight.New().DELETE("/"+name).
+		SetHeader(gofight.H{"Authorization": basic("edit")}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+}
+
+func TestPasswordHasher(t *testing.T) {
+	long := bytes.Repeat([]byte("a"), 80)
+	hash, err := Hasher.Hash(long)
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(hash, []byte("$argon2id$v=19$m=1024,t=1,p=1$")))
+	assert.True(t, VerifyPassword(hash, long))
+	assert.False(t, VerifyPassword(hash, append(long, 'b')))
+	assert.False(t, Hasher.NeedsRehash(hash))
+	assert.True(t, DefaultHasher.NeedsRehash(hash))
+
+	old, _ := (&BcryptHasher{Cost: bcrypt.MinCost}).Hash([]byte("pass"))
+	assert.True(t, VerifyPassword(old, []byte("pass")))
+	assert.True(t, Hasher.NeedsRehash(old))
+
+	// Hashes with invalid params don't match
+	assert.False(t, VerifyPassword([]byte("$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$a2V5"), long))
+
+	// Only limited number of keys is computed at once
+	defer SetArgon2Parallel(cap(argon2Slots))
+	SetArgon2Parallel(1)
+	argon2Slots <- struct{}{}
+	verified := make(chan bool)
+	go func() { verified <- VerifyPassword(hash, long) }()
+	select {
+	case <-verified:
+		t.Error("password verified without free slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-argon2Slots
+	assert.True(t, <-verified)
+
+	// Edit password is checked without holding write transaction
+	var editable string
+	env.r.POST("/").
+		SetForm(gofight.H{"f": "slow", "ep": "edit"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			editable = r.Body.String()
+		})
+	argon2Slots <- struct{}{}
+	edited := make(chan int)
+	go func() {
+		gofight.New().PUT("/"+editable).
+			SetForm(gofight.H{"f": "changed", "ep": "edit"}).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				edited <- r.Code
+			})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	updated := make(chan error)
+	go func() { updated <- db.Update(func(tx *bbolt.Tx) error { return nil }) }()
+	select {
+	case err := <-updated:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Error("write transaction waits for password hashing")
+	}
+	<-argon2Slots
+	assert.Equal(t, http.StatusOK, <-edited)
+
+	// Old hash is upgraded after successful check
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{"f": "old", "ap": "pass"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			name = r.Body.String()
+		})
+	UpdateWpaste([]byte(name), func(file *WpasteFile) error {
+		file.AccessHash = old
+		return nil
+	})
+	env.r.GET("/"+name).
+		SetQuery(gofight.H{"ap": "wrong"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		})
+	file, _ := OpenWpasteByName([]byte(name))
+	assert.Equal(t, old, file.AccessHash)
+	env.r.GET("/"+name).
+		SetQuery(gofight.H{"ap": "pass"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	for i := 0; i < 100 && Hasher.NeedsRehash(file.AccessHash); i++ {
+		time.Sleep(10 * time.Millisecond)
+		file, _ = OpenWpasteByName([]byte(name))
+	}
+	assert.False(t, Hasher.NeedsRehash(file.AccessHash))
+	assert.True(t, file.AllowAccess([]byte("pass")))
+}
+
+func TestPasswordAttempts(t *testing.T) {
+	defer func(file, client AttemptPolicy) {
+		FileAttempts, ClientAttempts = file, client
+	}(FileAttempts, ClientAttempts)
+	FileAttempts.Free = 4
+	ClientAttempts.Free = 2
+
+	var name string
+	env.r.POST("/").
+		SetForm(gofight.H{"f": "locked", "ap": "read", "ep": "edit"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			name = r.Body.String()
+		})
+	read := func(ip, password string, code int) {
+		gofight.New().GET("/"+name).
+			SetHeader(gofight.H{"X-Real-IP": ip, AccessPasswordHeader: password}).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, code, r.Code)
+				if code == http.StatusTooManyRequests {
+					assert.NotEmpty(t, r.HeaderMap.Get("Retry-After"))
+				}
+			})
+	}
+
+	// Client is locked out after too many failures
+	read("10.0.0.1", "wrong", http.StatusUnauthorized)
+	read("10.0.0.1", "wrong", http.StatusUnauthorized)
+	read("10.0.0.1", "wrong", http.StatusUnauthorized)
+	read("10.0.0.1", "read", http.StatusTooManyRequests)
+	// Request without password is not locked
+	read("10.0.0.1", "", http.StatusUnauthorized)
+
+	// File is locked out for everybody after more failures
+	read("10.0.0.2", "read", http.StatusOK)
+	read("10.0.0.2", "wrong", http.StatusUnauthorized)
+	read("10.0.0.3", "read", http.StatusOK)
+	gofight.New().DELETE("/"+name).
+		SetHeader(gofight.H{"X-Real-IP": "10.0.0.3", EditPasswordHeader: "wrong"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, r.Code)
+		})
+	read("10.0.0.4", "read", http.StatusTooManyRequests)
+	gofight.New().PUT("/"+name).
+		SetHeader(gofight.H{"X-Real-IP": "10.0.0.4", EditPasswordHeader: "edit"}).
+		SetForm(gofight.H{"f": "changed"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusTooManyRequests, r.Code)
+		})
+
+	// Attempts are stored in database
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Real-IP", "10.0.0.5")
+	assert.True(t, CheckAttempts(req, []byte(name)) > 0)
+	assert.NoError(t, DeleteOldAttempts())
+	assert.True(t, CheckAttempts(req, []byte(name)) > 0)
+
+	// X-Real-IP is ignored without trusted proxy
+	TrustProxy = false
+	defer func() { TrustProxy = true }()
+	req.RemoteAddr = "10.0.0.6:1234"
+	assert.Equal(t, "10.0.0.6", ClientIP(req))
+	assert.Equal(t, time.Duration(0), CheckAttempts(req, []byte("not-locked")))
+}
+
+func TestRateLimit(t *testing.T) {
+	defer CreateLimit.Set(CreateLimit.String())
+	assert.NoError(t, CreateLimit.Set("2/h"))
+	assert.Equal(t, "2/1h0m0s", CreateLimit.String())
+	assert.Error(t, CreateLimit.Set("many"))
+
+	upload := func(headers gofight.H, code int) {
+		gofight.New().POST("/").
+			SetHeader(headers).
+			SetForm(gofight.H{"f": "limited"}).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, code, r.Code)
+				if code == http.StatusTooManyRequests {
+					assert.Equal(t, "0", r.HeaderMap.Get("X-RateLimit-Remaining"))
+					assert.Equal(t, "1800", r.HeaderMap.Get("Retry-After"))
+				} else {
+					assert.Equal(t, "2", r.HeaderMap.Get("X-RateLimit-Limit"))
+				}
+			})
+	}
+	upload(gofight.H{"X-Real-IP": "10.0.1.1"}, http.StatusOK)
+	upload(gofight.H{"X-Real-IP": "10.0.1.1"}, http.StatusOK)
+	upload(gofight.H{"X-Real-IP": "10.0.1.1"}, http.StatusTooManyRequests)
+	upload(gofight.H{"X-Real-IP": "10.0.1.2"}, http.StatusOK)
+
+	// Account has its own limit wherever requests come from
+	var token string
+	env.r.POST("/api/v1/users").
+		SetForm(gofight.H{"name": "limited"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			token = r.Body.String()
+		})
+	auth := "Bearer " + token
+	upload(gofight.H{"X-Real-IP": "10.0.1.1", "Authorization": auth}, http.StatusOK)
+	upload(gofight.H{"X-Real-IP": "10.0.1.3", "Authorization": auth}, http.StatusOK)
+	upload(gofight.H{"X-Real-IP": "10.0.1.4", "Authorization": auth}, http.StatusTooManyRequests)
+}
+
+func TestQuota(t *testing.T) {
+	defer func(size int64, files int) {
+		QuotaBytes, QuotaFiles = size, files
+	}(QuotaBytes, QuotaFiles)
+	QuotaBytes, QuotaFiles = 10, 2
+
+	ip := gofight.H{"X-Real-IP": "10.0.2.1"}
+	upload := func(data string, code int) (name string) {
+		gofight.New().POST("/").
+			SetHeader(ip).
+			SetForm(gofight.H{"f": data, "ep": "edit"}).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.Equal(t, code, r.Code)
+				name = r.Body.String()
+			})
+		return
+	}
+	usage := func() (u Usage) {
+		gofight.New().GET("/api/v1/usage").
+			SetHeader(ip).
+			Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+				assert.NoError(t, json.Unmarshal(r.Body.Bytes(), &u))
+				assert.Contains(t, r.Body.String(), `"max_bytes":10`)
+			})
+		return
+	}
+
+	first := upload("123456", http.StatusOK)
+	upload("12345", http.StatusInsufficientStorage)
+	upload("12345678901", http.StatusRequestEntityTooLarge)
+	upload("1234", http.StatusOK)
+	assert.Equal(t, Usage{Bytes: 10, Files: 2}, usage())
+	upload("1", http.StatusInsufficientStorage)
+
+	// Edits are counted too
+	env.r.PUT("/"+first).
+		SetForm(gofight.H{"f": "1234567", "ep": "edit"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusInsufficientStorage, r.Code)
+		})
+	env.r.PUT("/"+first).
+		SetForm(gofight.H{"f": "12", "ep": "edit"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
+		})
+	env.r.POST("/"+first+"/append").
+		SetForm(gofight.H{"f": "34567", "ep": "edit"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusInsufficientStorage, r.Code)
+		})
+	assert.Equal(t, Usage{Bytes: 6, Files: 2}, usage())
+
+	// Usage is taken from current file, and file deleted twice is counted once
+	stale, err := OpenWpasteByName([]byte(first))
+	assert.NoError(t, err)
+	assert.NoError(t, UpdateWpaste(stale.Name, func(file *WpasteFile) error {
+		file.Data = []byte("123")
+		return nil
+	}))
+	assert.Equal(t, Usage{Bytes: 7, Files: 2}, usage())
+	assert.NoError(t, stale.Delete())
+	assert.Equal(t, ErrNotFound, stale.Delete())
+	assert.Equal(t, Usage{Bytes: 4, Files: 1}, usage())
+	first = upload("12", http.StatusOK)
+
+	env.r.DELETE("/"+first).
+		SetQuery(gofight.H{"ep": "edit"}).
+		Run(env.router, func(r gofight.HTTPResponse, rq gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, r.Code)
 		})
+	assert.Equal(t, Usage{Bytes: 4, Files: 1}, usage())
+	upload("123456", http.StatusOK)
 }
 
 func TestDeleteFile(t *testing.T) {
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// NameMinLength and NameMaxLength are bounds for custom file names
+const (
+	NameMinLength = 1
+	NameMaxLength = 64
+)
+
+// DefaultReservedNames is names that may be used by wpaste routes
+var DefaultReservedNames = []string{
+	"admin", "api", "assets", "help", "login", "logout", "static",
+	"user", "users",
+}
+
+var reservedNames = map[string]bool{}
+
+func init() {
+	SetReservedNames(DefaultReservedNames)
+}
+
+// SetReservedNames replace list of names which can't be taken by files
+func SetReservedNames(names []string) {
+	reservedNames = map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if len(name) != 0 {
+			reservedNames[name] = true
+		}
+	}
+}
+
+// ValidateName return error which describes why name can't be used
+// as file name or nil if it can
+func ValidateName(name string) error {
+	if len(name) < NameMinLength || len(name) > NameMaxLength {
+		return fmt.Errorf("Name length should be from %d to %d characters", NameMinLength, NameMaxLength)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return errors.New("Name may contain only latin letters, digits, '-' and '_'")
+		}
+	}
+	if reservedNames[strings.ToLower(name)] {
+		return fmt.Errorf("Name %q is reserved", name)
+	}
+	return nil
+}
+
+// SuggestName make file name from original filename, e.g. "build" for
+// "build.log", it return empty string if nothing suitable left
+func SuggestName(filename string) string {
+	stem := strings.TrimLeft(filename, ".")
+	if i := strings.IndexByte(stem, '.'); i != -1 {
+		stem = stem[:i]
+	}
+	name := strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			return c
+		}
+		return '-'
+	}, stem)
+	name = strings.Trim(name, "-")
+	// leave place for suffix which is added when name is taken
+	if len(name) > NameMaxLength-4 {
+		name = name[:NameMaxLength-4]
+	}
+	if ValidateName(name) != nil {
+		return ""
+	}
+	return name
+}
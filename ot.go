@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"unicode/utf8"
+)
+
+// Component is one step of Operation: Retain or Delete characters
+// or Insert text, only one of fields is set
+type Component struct {
+	Retain int
+	Delete int
+	Insert string
+}
+
+// Operation is change of whole text document made of components which
+// are applied one by one from the start of document, lengths are counted
+// in runes. It is encoded to JSON like in ot.js: positive numbers retain,
+// negative numbers delete and strings insert, e.g. [5, " world", -3]
+type Operation []Component
+
+// ErrInvalidOperation is returned when operation can't be applied
+var ErrInvalidOperation = errors.New("invalid operation")
+
+// Retain add retaining n characters to operation
+func (o Operation) Retain(n int) Operation {
+	if n <= 0 {
+		return o
+	}
+	if last := len(o) - 1; last >= 0 && o[last].Retain != 0 {
+		o[last].Retain += n
+		return o
+	}
+	return append(o, Component{Retain: n})
+}
+
+// Insert add inserting text to operation, insert is always placed
+// before delete so equal operations have equal components
+func (o Operation) Insert(text string) Operation {
+	if len(text) == 0 {
+		return o
+	}
+	last := len(o) - 1
+	switch {
+	case last >= 0 && len(o[last].Insert) != 0:
+		o[last].Insert += text
+	case last >= 0 && o[last].Delete != 0:
+		if last >= 1 && len(o[last-1].Insert) != 0 {
+			o[last-1].Insert += text
+		} else {
+			o = append(o, o[last])
+			o[last] = Component{Insert: text}
+		}
+	default:
+		o = append(o, Component{Insert: text})
+	}
+	return o
+}
+
+// Delete add deleting n characters to operation
+func (o Operation) Delete(n int) Operation {
+	if n <= 0 {
+		return o
+	}
+	if last := len(o) - 1; last >= 0 && o[last].Delete != 0 {
+		o[last].Delete += n
+		return o
+	}
+	return append(o, Component{Delete: n})
+}
+
+// BaseLen return length of document operation can be applied to
+func (o Operation) BaseLen() (n int) {
+	for _, c := range o {
+		n += c.Retain + c.Delete
+	}
+	return
+}
+
+// Apply return document changed by operation
+func (o Operation) Apply(doc []rune) ([]rune, error) {
+	if o.BaseLen() != len(doc) {
+		return nil, ErrInvalidOperation
+	}
+	result := make([]rune, 0, len(doc))
+	i := 0
+	for _, c := range o {
+		switch {
+		case c.Retain != 0:
+			if c.Retain < 0 || i+c.Retain > len(doc) {
+				return nil, ErrInvalidOperation
+			}
+			result = append(result, doc[i:i+c.Retain]...)
+			i += c.Retain
+		case c.Delete != 0:
+			if c.Delete < 0 || i+c.Delete > len(doc) {
+				return nil, ErrInvalidOperation
+			}
+			i += c.Delete
+		default:
+			result = append(result, []rune(c.Insert)...)
+		}
+	}
+	return result, nil
+}
+
+// Transform return operations a' and b' such that applying b' after a
+// gives the same document as applying a' after b, if a and b insert
+// text at the same position text of a goes first
+func Transform(a, b Operation) (Operation, Operation, error) {
+	if a.BaseLen() != b.BaseLen() {
+		return nil, nil, ErrInvalidOperation
+	}
+
+	var aPrime, bPrime Operation
+	i, j := 0, 0
+	var c1, c2 Component
+	next := func(o Operation, k *int) Component {
+		if *k < len(o) {
+			*k++
+			return o[*k-1]
+		}
+		return Component{}
+	}
+	empty := func(c Component) bool {
+		return c.Retain == 0 && c.Delete == 0 && len(c.Insert) == 0
+	}
+	c1, c2 = next(a, &i), next(b, &j)
+
+	for !empty(c1) || !empty(c2) {
+		if len(c1.Insert) != 0 {
+			aPrime = aPrime.Insert(c1.Insert)
+			bPrime = bPrime.Retain(utf8.RuneCountInString(c1.Insert))
+			c1 = next(a, &i)
+			continue
+		}
+		if len(c2.Insert) != 0 {
+			aPrime = aPrime.Retain(utf8.RuneCountInString(c2.Insert))
+			bPrime = bPrime.Insert(c2.Insert)
+			c2 = next(b, &j)
+			continue
+		}
+		if empty(c1) || empty(c2) {
+			return nil, nil, ErrInvalidOperation
+		}
+
+		// both components are retains or deletes, handle common part
+		n1, n2 := c1.Retain+c1.Delete, c2.Retain+c2.Delete
+		n := n1
+		if n2 < n {
+			n = n2
+		}
+		switch {
+		case c1.Retain != 0 && c2.Retain != 0:
+			aPrime = aPrime.Retain(n)
+			bPrime = bPrime.Retain(n)
+		case c1.Delete != 0 && c2.Retain != 0:
+			aPrime = aPrime.Delete(n)
+		case c1.Retain != 0 && c2.Delete != 0:
+			bPrime = bPrime.Delete(n)
+		}
+		// when both delete the same characters nothing is left to do
+
+		c1 = shorten(c1, n)
+		c2 = shorten(c2, n)
+		if empty(c1) {
+			c1 = next(a, &i)
+		}
+		if empty(c2) {
+			c2 = next(b, &j)
+		}
+	}
+	return aPrime, bPrime, nil
+}
+
+// shorten return retain or delete component shorter by n
+func shorten(c Component, n int) Component {
+	if c.Retain != 0 {
+		c.Retain -= n
+	} else {
+		c.Delete -= n
+	}
+	return c
+}
+
+// MarshalJSON encode operation like [5, "text", -3]
+func (o Operation) MarshalJSON() ([]byte, error) {
+	components := make([]interface{}, len(o))
+	for i, c := range o {
+		switch {
+		case c.Retain != 0:
+			components[i] = c.Retain
+		case c.Delete != 0:
+			components[i] = -c.Delete
+		default:
+			components[i] = c.Insert
+		}
+	}
+	return json.Marshal(components)
+}
+
+// UnmarshalJSON decode operation encoded like [5, "text", -3], numbers
+// can't be larger than MaxAppendedSize
+func (o *Operation) UnmarshalJSON(data []byte) error {
+	var components []interface{}
+	if err := json.Unmarshal(data, &components); err != nil {
+		return err
+	}
+	var op Operation
+	for _, c := range components {
+		switch c := c.(type) {
+		case float64:
+			if c != float64(int(c)) || c == 0 || c > MaxAppendedSize || c < -MaxAppendedSize {
+				return ErrInvalidOperation
+			} else if c > 0 {
+				op = op.Retain(int(c))
+			} else {
+				op = op.Delete(int(-c))
+			}
+		case string:
+			if len(c) == 0 {
+				return ErrInvalidOperation
+			}
+			op = op.Insert(c)
+		default:
+			return ErrInvalidOperation
+		}
+	}
+	*o = op
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"go.etcd.io/bbolt"
+)
+
+// Usage is how much data account or client keeps stored
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+// QuotaBytes and QuotaFiles limit total size and number of files stored
+// by each account or client address, 0 means unlimited
+var (
+	QuotaBytes int64 = 100 << 20
+	QuotaFiles       = 1000
+)
+
+// Size return size of file data including all files of multi-file paste
+func (w *WpasteFile) Size() int64 {
+	size := int64(len(w.Data))
+	for _, f := range w.Files {
+		size += int64(len(f.Data))
+	}
+	return size
+}
+
+// UsageKey return key of usage file is counted in: owner account
+// or address of client which uploaded it
+func (w *WpasteFile) UsageKey() string {
+	if len(w.Owner) != 0 {
+		return "u/" + w.Owner
+	} else if len(w.Uploader) != 0 {
+		return "c/" + w.Uploader
+	}
+	return ""
+}
+
+// requestUsageKey return usage key of account of API token or client address
+func requestUsageKey(r *http.Request, user *User) string {
+	if user != nil {
+		return "u/" + user.Name
+	}
+	return "c/" + ClientIP(r)
+}
+
+func getUsage(tx *bbolt.Tx, key string) (*Usage, error) {
+	var usage Usage
+	v := tx.Bucket([]byte("usage")).Get([]byte(key))
+	if v == nil {
+		return &usage, nil
+	}
+	err := gob.NewDecoder(bytes.NewReader(v)).Decode(&usage)
+	return &usage, err
+}
+
+// addUsage change usage of key by size and number of files, growth
+// over quota returns StatusError
+func addUsage(tx *bbolt.Tx, key string, size int64, files int) error {
+	if len(key) == 0 || (size == 0 && files == 0) {
+		return nil
+	}
+	usage, err := getUsage(tx, key)
+	if err != nil {
+		return err
+	}
+	usage.Bytes += size
+	usage.Files += files
+
+	if size > 0 && QuotaBytes != 0 && usage.Bytes > QuotaBytes {
+		if size > QuotaBytes {
+			return &StatusError{http.StatusRequestEntityTooLarge, fmt.Sprintf("413 - File is larger than storage quota of %d bytes", QuotaBytes)}
+		}
+		return &StatusError{http.StatusInsufficientStorage, fmt.Sprintf("507 - Storage quota exceeded, %d of %d bytes are used", usage.Bytes-size, QuotaBytes)}
+	} else if files > 0 && QuotaFiles != 0 && usage.Files > QuotaFiles {
+		return &StatusError{http.StatusInsufficientStorage, fmt.Sprintf("507 - Files quota exceeded, %d of %d files are stored", usage.Files-files, QuotaFiles)}
+	}
+
+	bucket := tx.Bucket([]byte("usage"))
+	if usage.Bytes <= 0 && usage.Files <= 0 {
+		return bucket.Delete([]byte(key))
+	}
+	var v bytes.Buffer
+	if err := gob.NewEncoder(&v).Encode(usage); err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), v.Bytes())
+}
+
+// countAllUsage add all files to usage, used when usage is created
+func countAllUsage(tx *bbolt.Tx) error {
+	return tx.Bucket([]byte("files")).ForEach(func(k, v []byte) error {
+		f, err := DeserializeWpasteFile(v)
+		if err != nil {
+			return err
+		}
+		key := f.UsageKey()
+		if len(key) == 0 {
+			return nil
+		}
+		usage, err := getUsage(tx, key)
+		if err != nil {
+			return err
+		}
+		usage.Bytes += f.Size()
+		usage.Files++
+		var b bytes.Buffer
+		if err := gob.NewEncoder(&b).Encode(usage); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("usage")).Put([]byte(key), b.Bytes())
+	})
+}
+
+// ShowUsage respond JSON with usage and quota of account of API token
+// or client address
+func ShowUsage(w http.ResponseWriter, r *http.Request) {
+	user, err := Authenticate(r)
+	if err != nil {
+		HTTPStatusError(w, err)
+		return
+	}
+
+	var usage *Usage
+	err = db.View(func(tx *bbolt.Tx) (err error) {
+		usage, err = getUsage(tx, requestUsageKey(r, user))
+		return
+	})
+	if err != nil {
+		HTTPStatusError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*Usage
+		MaxBytes int64 `json:"max_bytes"`
+		MaxFiles int   `json:"max_files"`
+	}{usage, QuotaBytes, QuotaFiles})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter gives each client bucket of Limit tokens which is refilled
+// over Period, every request takes one token
+type RateLimiter struct {
+	// Limit is number of requests per Period, 0 means unlimited
+	Limit  int
+	Period time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewRateLimiter creates RateLimiter and return it
+func NewRateLimiter(limit int, period time.Duration) *RateLimiter {
+	return &RateLimiter{Limit: limit, Period: period}
+}
+
+// Rate limits for kinds of requests
+var (
+	CreateLimit = NewRateLimiter(30, time.Minute)
+	EditLimit   = NewRateLimiter(60, time.Minute)
+	ReadLimit   = NewRateLimiter(600, time.Minute)
+	DeleteLimit = NewRateLimiter(60, time.Minute)
+)
+
+// Allow take token from bucket of key, it return number of tokens left,
+// time until bucket is full and false if bucket is empty
+func (l *RateLimiter) Allow(key string) (remaining int, reset time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	rate := float64(l.Limit) / float64(l.Period)
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+	}
+	if now.Sub(l.swept) > l.Period {
+		// full buckets are the same as missing ones
+		for k, b := range l.buckets {
+			if b.tokens+float64(now.Sub(b.updated))*rate >= float64(l.Limit) {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(l.Limit), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.Limit), b.tokens+float64(now.Sub(b.updated))*rate)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	}
+	reset = time.Duration((float64(l.Limit) - b.tokens) / rate)
+	return int(b.tokens), reset, ok
+}
+
+// String implements flag.Value
+func (l *RateLimiter) String() string {
+	if l == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%s", l.Limit, l.Period)
+}
+
+// Set implements flag.Value, limit is like "30/m", "100/10m" or "0"
+// to disable limit
+func (l *RateLimiter) Set(s string) error {
+	parts := strings.SplitN(s, "/", 2)
+	limit, err := strconv.Atoi(parts[0])
+	if err != nil || limit < 0 {
+		return errors.New("limit should be like 30/m")
+	}
+	period := time.Second
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "s":
+		case "m":
+			period = time.Minute
+		case "h":
+			period = time.Hour
+		default:
+			if period, err = time.ParseDuration(parts[1]); err != nil || period <= 0 {
+				return errors.New("limit should be like 30/m")
+			}
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Limit, l.Period, l.buckets = limit, period, nil
+	return nil
+}
+
+// rateLimitKey return account of valid API token or client IP
+func rateLimitKey(r *http.Request) string {
+	if user, err := Authenticate(r); err == nil && user != nil {
+		return "u/" + user.Name
+	}
+	return "c/" + ClientIP(r)
+}
+
+// limited responds 429 if client has made too many requests of kind
+// limited by l, otherwise it calls handler, X-RateLimit-* headers are
+// set to every response
+func limited(l *RateLimiter, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l.Limit == 0 {
+			handler(w, r)
+			return
+		}
+		remaining, reset, ok := l.Allow(rateLimitKey(r))
+		seconds := int64(math.Ceil(reset.Seconds()))
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(l.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(seconds, 10))
+		if !ok {
+			wait := time.Duration(float64(l.Period) / float64(l.Limit))
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+			HTTPError(w, http.StatusTooManyRequests, "429 - Too many requests, try again later")
+			return
+		}
+		handler(w, r)
+	}
+}
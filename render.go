@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/formatters"
+	"github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	mdhtml "github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// HighlightStyle is chroma style used for HTML view
+var HighlightStyle = styles.Get("github")
+
+// TerminalStyle is chroma style used for ANSI colored output
+var TerminalStyle = styles.Get("monokai")
+
+// Lexer return lexer for language name or file extension,
+// if lang is empty or unknown language guessed by data
+func Lexer(lang string, data []byte) chroma.Lexer {
+	var lexer chroma.Lexer
+	if len(lang) != 0 {
+		lexer = lexers.Get(lang)
+	}
+	if lexer == nil {
+		lexer = lexers.Analyse(string(data))
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	return chroma.Coalesce(lexer)
+}
+
+// page is data for pageTemplate
+type page struct {
+	Title  string
+	CSS    template.CSS
+	Body   template.HTML
+	Script template.JS
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { margin: 0; }
+.markdown { max-width: 50em; margin: 0 auto; padding: 1em; font-family: sans-serif; line-height: 1.5; }
+.markdown pre { padding: .5em; overflow: auto; }
+.markdown table { border-collapse: collapse; }
+.markdown th, .markdown td { border: 1px solid #ddd; padding: .3em .6em; }
+.markdown img { max-width: 100%; }
+.index { font-family: monospace; line-height: 1.8; }
+{{.CSS}}
+</style>
+</head>
+<body>
+{{.Body}}
+{{if .Script}}<script>{{.Script}}</script>
+{{end}}</body>
+</html>
+`))
+
+var indexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{
+	"pathEscape": url.PathEscape,
+}).Parse(`<ul class="index">
+{{range .Files}}<li><a href="/{{$.Name}}/{{pathEscape .Filename}}">{{.Filename}}</a> <small>{{len .Data}} bytes, {{.Type}}</small></li>
+{{end}}</ul>
+`))
+
+// RenderIndex write HTML page with links to files of multi-file paste
+func RenderIndex(w io.Writer, name string, files []BundleFile) error {
+	var body bytes.Buffer
+	err := indexTemplate.Execute(&body, struct {
+		Name  string
+		Files []BundleFile
+	}{name, files})
+	if err != nil {
+		return err
+	}
+
+	return pageTemplate.Execute(w, page{Title: name, Body: template.HTML(body.String())})
+}
+
+// lineHighlightScript highlights lines selected by anchor like #L5 or
+// #L5-L10, shift-click on line number extends selection
+const lineHighlightScript = `(function () {
+	function highlight() {
+		var m = /^#L(\d+)(?:-L?(\d+))?$/.exec(location.hash);
+		document.querySelectorAll(".chroma .hl").forEach(function (line) {
+			line.classList.remove("hl");
+		});
+		if (!m) return;
+		var from = +m[1], to = +(m[2] || m[1]);
+		for (var i = from; i <= to; i++) {
+			var ln = document.getElementById("L" + i);
+			if (ln) ln.parentNode.classList.add("hl");
+		}
+		var first = document.getElementById("L" + from);
+		if (first) first.scrollIntoView();
+	}
+	document.addEventListener("click", function (e) {
+		var a = e.target.closest(".chroma .ln a");
+		var m = /^#L(\d+)/.exec(location.hash);
+		if (!a || !e.shiftKey || !m) return;
+		e.preventDefault();
+		var from = +m[1], to = +a.hash.slice(2);
+		location.hash = "#L" + Math.min(from, to) + "-L" + Math.max(from, to);
+	});
+	window.addEventListener("hashchange", highlight);
+	highlight();
+})();`
+
+// HighlightHTML write HTML page with highlighted data, line numbers
+// and line anchors (#L1, #L2, ...), lines in highlight ranges are marked
+func HighlightHTML(w io.Writer, title, lang string, data []byte, highlight [][2]int) error {
+	iterator, err := Lexer(lang, data).Tokenise(nil, string(data))
+	if err != nil {
+		return err
+	}
+
+	formatter := html.New(
+		html.WithClasses(true),
+		html.WithLineNumbers(true),
+		html.LinkableLineNumbers(true, "L"),
+		html.HighlightLines(highlight),
+		html.TabWidth(4),
+	)
+
+	var css, body bytes.Buffer
+	if err := formatter.WriteCSS(&css, HighlightStyle); err != nil {
+		return err
+	}
+	if err := formatter.Format(&body, HighlightStyle, iterator); err != nil {
+		return err
+	}
+
+	return pageTemplate.Execute(w, page{
+		Title:  title,
+		CSS:    template.CSS(css.String()),
+		Body:   template.HTML(body.String()),
+		Script: lineHighlightScript,
+	})
+}
+
+// HighlightANSI write data highlighted with ANSI escape codes, if
+// lineNumbers is true each line is prefixed with its number starting from first
+func HighlightANSI(w io.Writer, lang string, data []byte, lineNumbers bool, first int) error {
+	iterator, err := Lexer(lang, data).Tokenise(nil, string(data))
+	if err != nil {
+		return err
+	}
+	if !lineNumbers {
+		return formatters.TTY256.Format(w, TerminalStyle, iterator)
+	}
+
+	lines := chroma.SplitTokensIntoLines(iterator.Tokens())
+	digits := len(fmt.Sprint(first + len(lines) - 1))
+	for i, tokens := range lines {
+		// newline is written after formatted tokens so colors are reset
+		// before it and next line number is not colored
+		last := &tokens[len(tokens)-1]
+		newline := strings.HasSuffix(last.Value, "\n")
+		last.Value = strings.TrimSuffix(last.Value, "\n")
+
+		fmt.Fprintf(w, "\x1b[38;5;244m%*d\x1b[0m  ", digits, first+i)
+		if err := formatters.TTY256.Format(w, TerminalStyle, chroma.Literator(tokens...)); err != nil {
+			return err
+		}
+		if newline {
+			io.WriteString(w, "\n")
+		}
+	}
+	return nil
+}
+
+// MarkdownCSP is Content-Security-Policy for rendered markdown,
+// it forbids scripts in case something slipped through the renderer
+const MarkdownCSP = "default-src 'none'; style-src 'unsafe-inline'; img-src http: https: data:"
+
+// markdownExtensions is parser extensions for pastes, extensions which
+// let user set raw attributes or include files are not allowed
+const markdownExtensions = parser.NoIntraEmphasis | parser.Tables | parser.FencedCode |
+	parser.Autolink | parser.Strikethrough | parser.SpaceHeadings | parser.AutoHeadingIDs |
+	parser.BackslashLineBreak | parser.DefinitionLists | parser.Footnotes
+
+// safeURL return true if url is relative or uses one of web schemes
+func safeURL(dest []byte) bool {
+	u, err := url.Parse(string(dest))
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+// markdownHook highlights fenced code and drops images with unsafe source
+func markdownHook(formatter *html.Formatter) mdhtml.RenderNodeFunc {
+	return func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+		switch node := node.(type) {
+		case *ast.CodeBlock:
+			var lang string
+			if f := strings.Fields(string(node.Info)); len(f) != 0 {
+				lang = f[0]
+			}
+			iterator, err := Lexer(lang, node.Literal).Tokenise(nil, string(node.Literal))
+			if err != nil || formatter.Format(w, HighlightStyle, iterator) != nil {
+				return ast.GoToNext, false
+			}
+			return ast.GoToNext, true
+		case *ast.Image:
+			if !safeURL(node.Destination) {
+				return ast.SkipChildren, true
+			}
+		}
+		return ast.GoToNext, false
+	}
+}
+
+// RenderMarkdown write HTML page with rendered markdown data, raw HTML
+// is skipped and only links with safe schemes are kept
+func RenderMarkdown(w io.Writer, title string, data []byte) error {
+	formatter := html.New(html.WithClasses(true), html.TabWidth(4))
+
+	renderer := mdhtml.NewRenderer(mdhtml.RendererOptions{
+		Flags:          mdhtml.SkipHTML | mdhtml.Safelink | mdhtml.NofollowLinks,
+		RenderNodeHook: markdownHook(formatter),
+	})
+	body := markdown.ToHTML(data, parser.NewWithExtensions(markdownExtensions), renderer)
+
+	var css bytes.Buffer
+	if err := formatter.WriteCSS(&css, HighlightStyle); err != nil {
+		return err
+	}
+
+	return pageTemplate.Execute(w, page{
+		Title: title,
+		CSS:   template.CSS(css.String()),
+		Body:  template.HTML(`<div class="markdown">` + string(body) + `</div>`),
+	})
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.etcd.io/bbolt"
+)
+
+// Scopes of share tokens
+const (
+	ScopeRead   = "read"
+	ScopeEdit   = "edit"
+	ScopeDelete = "delete"
+)
+
+// Share is token which gives access to one file with limited scopes,
+// shares are stored in bucket of file in "shares" bucket by token hash
+type Share struct {
+	Scopes []string
+	// Created is time in UTC and UnixNano when share issued
+	Created int64
+	// ExpiresAfter is time in UTC and UnixNano when share expires,
+	// it never expires if it is 0
+	ExpiresAfter int64
+	// Uses is how many times share can be used, unlimited if it is 0
+	Uses int
+}
+
+// Errors of shares
+var (
+	ErrInvalidShare  = &StatusError{http.StatusUnauthorized, "401 - Invalid share token"}
+	ErrShareNotFound = &StatusError{http.StatusNotFound, "404 - Share not found"}
+)
+
+// Allow return true if share has scope and isn't expired
+func (s *Share) Allow(scope string) bool {
+	if s.ExpiresAfter != 0 && time.Now().UTC().UnixNano() > s.ExpiresAfter {
+		return false
+	}
+	for _, sc := range s.Scopes {
+		if sc == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeShare(v []byte) (*Share, error) {
+	var share Share
+	err := gob.NewDecoder(bytes.NewReader(v)).Decode(&share)
+	return &share, err
+}
+
+func encodeShare(share *Share) ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(share)
+	return b.Bytes(), err
+}
+
+// shareID return public ID of share by key, it is used to list
+// and revoke shares without knowing tokens
+func shareID(key []byte) string {
+	return hex.EncodeToString(key[:8])
+}
+
+// NewShare save share for file and return its token
+func NewShare(name []byte, share *Share) (string, error) {
+	token, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	v, err := encodeShare(share)
+	if err != nil {
+		return "", err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte("files")).Get(name) == nil {
+			return ErrNotFound
+		}
+		shares, err := tx.Bucket([]byte("shares")).CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		return shares.Put(tokenKey(token), v)
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// UseShare check that token gives scope for file and count its use,
+// share is removed when it is used up
+func UseShare(name []byte, token, scope string) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		return useShare(tx, name, token, scope)
+	})
+}
+
+// useShare is UseShare in transaction tx
+func useShare(tx *bbolt.Tx, name []byte, token, scope string) error {
+	shares := tx.Bucket([]byte("shares")).Bucket(name)
+	if shares == nil {
+		return ErrInvalidShare
+	}
+	key := tokenKey(token)
+	v := shares.Get(key)
+	if v == nil {
+		return ErrInvalidShare
+	}
+	share, err := decodeShare(v)
+	if err != nil {
+		return err
+	} else if !share.Allow(scope) {
+		return ErrInvalidShare
+	}
+
+	switch share.Uses {
+	case 0:
+		return nil
+	case 1:
+		return shares.Delete(key)
+	}
+	share.Uses--
+	if v, err = encodeShare(share); err != nil {
+		return err
+	}
+	return shares.Put(key, v)
+}
+
+// allowShare return true if request has share token which
+// gives scope for file, it counts use of token
+func allowShare(r *http.Request, name []byte, scope string) bool {
+	if len(ShareToken(r)) == 0 {
+		return false
+	}
+	var ok bool
+	db.Update(func(tx *bbolt.Tx) error {
+		ok = allowShareTx(tx, r, name, scope)
+		return nil
+	})
+	return ok
+}
+
+// allowShareTx is allowShare in transaction tx, use of token is not
+// counted if tx is rolled back
+func allowShareTx(tx *bbolt.Tx, r *http.Request, name []byte, scope string) bool {
+	token := ShareToken(r)
+	if len(token) == 0 {
+		return false
+	}
+	err := useShare(tx, name, token, scope)
+	if err != nil && err != ErrInvalidShare {
+		log.Println(err)
+	}
+	return err == nil
+}
+
+// deleteShares remove all shares of file
+func deleteShares(tx *bbolt.Tx, name []byte) error {
+	err := tx.Bucket([]byte("shares")).DeleteBucket(name)
+	if err == bbolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
+
+// ShareInfo is share data sent by API
+type ShareInfo struct {
+	ID      string     `json:"id"`
+	Scopes  []string   `json:"scopes"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Uses    int        `json:"uses,omitempty"`
+}
+
+// FileShares return shares of file
+func FileShares(name []byte) ([]ShareInfo, error) {
+	list := []ShareInfo{}
+	err := db.View(func(tx *bbolt.Tx) error {
+		shares := tx.Bucket([]byte("shares")).Bucket(name)
+		if shares == nil {
+			return nil
+		}
+		return shares.ForEach(func(k, v []byte) error {
+			share, err := decodeShare(v)
+			if err != nil {
+				return err
+			}
+			info := ShareInfo{
+				ID:      shareID(k),
+				Scopes:  share.Scopes,
+				Created: time.Unix(0, share.Created).UTC(),
+				Uses:    share.Uses,
+			}
+			if share.ExpiresAfter != 0 {
+				expires := time.Unix(0, share.ExpiresAfter).UTC()
+				info.Expires = &expires
+			}
+			list = append(list, info)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// DeleteShare revoke share of file by its ID
+func DeleteShare(name []byte, id string) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		shares := tx.Bucket([]byte("shares")).Bucket(name)
+		if shares == nil {
+			return ErrShareNotFound
+		}
+		c := shares.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if shareID(k) == id {
+				return c.Delete()
+			}
+		}
+		return ErrShareNotFound
+	})
+}
+
+// openEditable return file by ID from request if it can be edited by
+// user or with edit password, otherwise it write error and return nil
+func openEditable(w http.ResponseWriter, r *http.Request) *WpasteFile {
+	user, err := Authenticate(r)
+	if err != nil {
+		HTTPStatusError(w, err)
+		return nil
+	}
+	file, err := OpenWpasteByName([]byte(mux.Vars(r)["id"]))
+	if err != nil {
+		HTTPServerError(w)
+		return nil
+	}
+	r.ParseForm()
+	if !file.Exist() {
+		HTTPError(w, http.StatusNotFound, "404 - File not found")
+		return nil
+	} else if file.Expired() {
+		HTTPError(w, http.StatusGone, "410 - File is no longer available")
+		return nil
+	} else if passwordLocked(w, r, file.Name, EditPassword(r)) {
+		return nil
+	} else if !file.AllowEditBy(user, EditPassword(r)) {
+		failedPassword(r, file.Name, EditPassword(r))
+		HTTPError(w, http.StatusUnauthorized, "401 - Invalid password")
+		return nil
+	}
+	return file
+}
+
+// IssueShare respond new share token of file with scopes from "scope"
+// (read by default), expiring after "e" seconds and valid for "uses" uses
+func IssueShare(w http.ResponseWriter, r *http.Request) {
+	file := openEditable(w, r)
+	if file == nil {
+		return
+	}
+
+	share := &Share{Created: time.Now().UTC().UnixNano()}
+	scope := r.FormValue("scope")
+	if len(scope) == 0 {
+		scope = ScopeRead
+	}
+	for _, sc := range strings.Split(scope, ",") {
+		sc = strings.TrimSpace(sc)
+		if sc != ScopeRead && sc != ScopeEdit && sc != ScopeDelete {
+			HTTPError(w, http.StatusBadRequest, "400 - Scope should be read, edit or delete")
+			return
+		}
+		share.Scopes = append(share.Scopes, sc)
+	}
+	if e := r.FormValue("e"); len(e) != 0 {
+		seconds, err := strconv.ParseInt(e, 10, 64)
+		if err != nil || seconds <= 0 {
+			HTTPError(w, http.StatusBadRequest, "400 - Time shold be positive")
+			return
+		}
+		share.ExpiresAfter = share.Created + seconds*int64(time.Second)
+	}
+	if uses := r.FormValue("uses"); len(uses) != 0 {
+		n, err := strconv.Atoi(uses)
+		if err != nil || n <= 0 {
+			HTTPError(w, http.StatusBadRequest, "400 - Uses should be positive")
+			return
+		}
+		share.Uses = n
+	}
+
+	token, err := NewShare(file.Name, share)
+	if err != nil {
+		HTTPStatusError(w, err)
+		return
+	}
+	w.Write([]byte(token))
+}
+
+// ListShares respond JSON with shares of file
+func ListShares(w http.ResponseWriter, r *http.Request) {
+	file := openEditable(w, r)
+	if file == nil {
+		return
+	}
+
+	shares, err := FileShares(file.Name)
+	if err != nil {
+		HTTPStatusError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shares)
+}
+
+// RevokeShare remove share of file by its ID
+func RevokeShare(w http.ResponseWriter, r *http.Request) {
+	file := openEditable(w, r)
+	if file == nil {
+		return
+	}
+
+	if err := DeleteShare(file.Name, mux.Vars(r)["share"]); err != nil {
+		HTTPStatusError(w, err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SigningKeysEnv is environment variable with comma-separated keys for
+// signed URLs
+const SigningKeysEnv = "WPASTE_SIGNING_KEYS"
+
+// signingKeys is keys for signed URLs, the first key signs URLs and all
+// keys are accepted, so links signed before rotation keep working
+var signingKeys [][]byte
+
+func init() {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	signingKeys = [][]byte{key}
+}
+
+// SetSigningKeys replace keys for signed URLs, the first key signs new
+// URLs, empty keys are ignored and random key is kept if there are no keys
+func SetSigningKeys(keys []string) {
+	var result [][]byte
+	for _, key := range keys {
+		if key = strings.TrimSpace(key); len(key) != 0 {
+			result = append(result, []byte(key))
+		}
+	}
+	if len(result) != 0 {
+		signingKeys = result
+	}
+}
+
+// signature return signature of read access to file until exp, creation
+// time of file is signed too so link doesn't work for new file with
+// the same name
+func signature(key []byte, file *WpasteFile, exp int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(file.Name)
+	mac.Write([]byte("\n" + strconv.FormatInt(file.Created, 10)))
+	mac.Write([]byte("\n" + strconv.FormatInt(exp, 10)))
+	return mac.Sum(nil)
+}
+
+// SignURL return path to file with "exp" and "sig" params which gives
+// read access to it until exp (Unix time)
+func SignURL(file *WpasteFile, exp int64) string {
+	sig := base64.RawURLEncoding.EncodeToString(signature(signingKeys[0], file, exp))
+	return "/" + url.PathEscape(string(file.Name)) + "?" + url.Values{
+		"exp": {strconv.FormatInt(exp, 10)},
+		"sig": {sig},
+	}.Encode()
+}
+
+// VerifySignature return true if sig is valid signature of file for
+// exp made by one of keys and exp is in the future
+func VerifySignature(file *WpasteFile, exp, sig string) bool {
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	for _, key := range signingKeys {
+		if hmac.Equal(mac, signature(key, file, expires)) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowSigned return true if request has valid "exp" and "sig" params
+func allowSigned(r *http.Request, file *WpasteFile) bool {
+	sig := r.Form.Get("sig")
+	return len(sig) != 0 && VerifySignature(file, r.Form.Get("exp"), sig)
+}
+
+// MaxSignedTime is max lifetime of signed URL in seconds
+const MaxSignedTime = 365 * 24 * 60 * 60
+
+// SignFile respond signed URL which gives read access to file for
+// "e" seconds (1 hour by default)
+func SignFile(w http.ResponseWriter, r *http.Request) {
+	file := openEditable(w, r)
+	if file == nil {
+		return
+	}
+
+	seconds := int64(3600)
+	if e := r.FormValue("e"); len(e) != 0 {
+		var err error
+		seconds, err = strconv.ParseInt(e, 10, 64)
+		if err != nil || seconds <= 0 || seconds > MaxSignedTime {
+			HTTPError(w, http.StatusBadRequest, "400 - Time should be from 1 second to 1 year")
+			return
+		}
+	}
+	w.Write([]byte(SignURL(file, time.Now().Unix()+seconds)))
+}